@@ -3,7 +3,11 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"time"
 
+	"github.com/MarcPer/lanchat/lan"
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -14,6 +18,19 @@ type config struct {
 	port      int
 	notify    bool
 	forceHost bool
+	discovery string
+	network   string
+	roomKey   string
+	include   []string
+	exclude   []string
+	dir       string
+	history   int
+	log       bool
+	retention time.Duration
+	logReplay int
+	maxMissed int
+	downloads string
+	awayAfter time.Duration
 }
 
 func newConfig() config {
@@ -22,6 +39,19 @@ func newConfig() config {
 	flag.BoolP("notify", "n", true, "whether to send system notifications upon message receivals. Notifications have a cooldown time.")
 	flag.BoolP("force-host", "f", false, "start as host without scanning for peers")
 	flag.IntP("port", "p", 6776, "port ")
+	flag.String("discovery", "beacon", "how to find a running host: 'beacon' broadcasts a UDP probe, falling back to 'sweep', which tries to connect to every address in the network")
+	flag.String("network", "lanchat", "name of the chat network (room); hosts of other networks are ignored by beacon discovery")
+	flag.String("room-key", "", "secret peers must know to join the chat; it is never sent over the network")
+	flag.StringSlice("interfaces", nil, "network interfaces to scan for hosts; by default, all interfaces except virtual ones (e.g. docker0) are scanned")
+	flag.StringSlice("exclude-interfaces", nil, "network interfaces not to scan for hosts")
+	flag.Int("history", lan.DefaultHistorySize, "number of recent messages shown to peers joining later; 0 disables history")
+	flag.Bool("log", true, "whether to save messages to disk, under the config directory")
+	flag.Duration("log-retention", 30*24*time.Hour, "how long saved messages are kept; 0 keeps them forever")
+	flag.Int("log-replay", 50, "number of saved messages shown per room on start")
+	flag.Int("max-missed-pings", lan.DefaultMaxMissedPings, "number of pings in a row a peer may leave unanswered before being disconnected; 0 never disconnects them")
+	flag.Duration("away-after", 10*time.Minute, "time without typing after which you are marked as away; 0 disables it")
+	flag.String("download-dir", defaultDownloadDir(), "directory where files received from peers are saved")
+	flag.String("config-dir", defaultConfigDir(), "directory where keys and fingerprints of known peers are stored")
 	var cfgPath = flag.StringP("config", "c", "", "path to config file")
 
 	flag.Parse()
@@ -41,5 +71,34 @@ func newConfig() config {
 		notify:    viper.GetBool("notify"),
 		port:      viper.GetInt("port"),
 		forceHost: viper.GetBool("force-host"),
+		discovery: viper.GetString("discovery"),
+		network:   viper.GetString("network"),
+		roomKey:   viper.GetString("room-key"),
+		include:   viper.GetStringSlice("interfaces"),
+		exclude:   viper.GetStringSlice("exclude-interfaces"),
+		dir:       viper.GetString("config-dir"),
+		history:   viper.GetInt("history"),
+		log:       viper.GetBool("log"),
+		retention: viper.GetDuration("log-retention"),
+		logReplay: viper.GetInt("log-replay"),
+		maxMissed: viper.GetInt("max-missed-pings"),
+		downloads: viper.GetString("download-dir"),
+		awayAfter: viper.GetDuration("away-after"),
 	}
 }
+
+func defaultDownloadDir() string {
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(dir, "Downloads")
+}
+
+func defaultConfigDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".lanchat"
+	}
+	return filepath.Join(dir, "lanchat")
+}
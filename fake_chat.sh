@@ -21,8 +21,13 @@ active_window=$(tmux list-windows -F "#{window_active} #{window_id}" | awk '$1 =
 multi_pane=$(tmux list-panes | wc -l)
 active_pane=$(tmux list-panes -F "#{pane_active} #{pane_index}" | awk '$1 == 1 { print $2 }')
 
+# Each user gets their own config directory, so that they have separate
+# identity keys and known peers
+config_dirs=$(mktemp -d)
+mkdir "${config_dirs}/anna" "${config_dirs}/bob" "${config_dirs}/conan"
 
 cleanup() {
+	rm -rf "$config_dirs"
 	if [[ $multi_pane -gt 1 ]] ; then
 		tmux join-pane -t "${active_window}.right" 2>/dev/null
 		sleep 0.1
@@ -37,11 +42,11 @@ cleanup() {
 trap cleanup SIGHUP SIGINT SIGTERM
 
 echo -n "Starting chats "
-tmux new-window -d -n fake_chat "bin/lanchat -u anna -l -f"
+tmux new-window -d -n fake_chat "bin/lanchat -u anna -l -f --config-dir ${config_dirs}/anna"
 sleep 3 && echo -n "."
-tmux split-window -h -t fake_chat "bin/lanchat -u bob -l"
+tmux split-window -h -t fake_chat "bin/lanchat -u bob -l --config-dir ${config_dirs}/bob"
 sleep 0.1 && echo -n "."
-tmux split-window -v -t fake_chat.right "bin/lanchat -u conan -l"
+tmux split-window -v -t fake_chat.right "bin/lanchat -u conan -l --config-dir ${config_dirs}/conan"
 sleep 0.1 && echo -n "."
 
 tmux send-keys -t fake_chat.left "hello, my friend" Enter
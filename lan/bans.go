@@ -0,0 +1,121 @@
+package lan
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BanList holds the users and addresses banned from the chat with :ban,
+// along with when their ban expires. It is stored as a text file with one
+// ban per line: the user name or IP address, the expiry time, or "-" if the
+// ban never expires, and the address a banned user connected from, or "-".
+type BanList struct {
+	path string
+	mu   sync.Mutex
+	bans map[string]ban
+}
+
+type ban struct {
+	addr  string    // IP address a banned user connected from, banned along with them
+	until time.Time // zero for bans which never expire
+}
+
+func (b ban) expired() bool {
+	return !b.until.IsZero() && time.Now().After(b.until)
+}
+
+func LoadBanList(path string) (*BanList, error) {
+	l := &BanList{path: path, bans: make(map[string]ban)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		var b ban
+		if fields[1] != "-" {
+			if b.until, err = time.Parse(time.RFC3339, fields[1]); err != nil {
+				continue
+			}
+		}
+		if fields[2] != "-" {
+			b.addr = fields[2]
+		}
+		l.bans[fields[0]] = b
+	}
+	return l, scanner.Err()
+}
+
+// Add bans a user name or IP address for d, or forever if d is zero. The
+// address a banned user connects from may be given, to ban it as well.
+func (l *BanList) Add(target, addr string, d time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := ban{addr: addr}
+	if d > 0 {
+		b.until = time.Now().Add(d)
+	}
+	l.bans[target] = b
+	return l.save()
+}
+
+// Remove lifts the ban of a user name or IP address, returning whether it
+// was banned
+func (l *BanList) Remove(target string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.bans[target]
+	if !ok || b.expired() {
+		return false, nil
+	}
+	delete(l.bans, target)
+	return true, l.save()
+}
+
+// Banned returns whether a user with the given name, connecting from the
+// given IP address, is banned. Either may be empty.
+func (l *BanList) Banned(name, ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for target, b := range l.bans {
+		if b.expired() {
+			continue
+		}
+		if (name != "" && target == name) || (ip != "" && (target == ip || b.addr == ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the bans which haven't expired yet. Callers must hold mu.
+func (l *BanList) save() error {
+	var sb strings.Builder
+	for target, b := range l.bans {
+		if b.expired() {
+			delete(l.bans, target)
+			continue
+		}
+		until, addr := "-", "-"
+		if !b.until.IsZero() {
+			until = b.until.Format(time.RFC3339)
+		}
+		if b.addr != "" {
+			addr = b.addr
+		}
+		fmt.Fprintf(&sb, "%s %s %s\n", target, until, addr)
+	}
+	return ioutil.WriteFile(l.path, []byte(sb.String()), 0600)
+}
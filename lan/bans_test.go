@@ -0,0 +1,61 @@
+package lan
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	path := filepath.Join(tempDir(t), "bans")
+	l, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Add("jon", "10.0.0.2", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Add("10.0.0.3", "", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Add("ann", "", time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	// bans survive restarts
+	l, err = LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		user   string
+		ip     string
+		banned bool
+	}{
+		{"banned user", "jon", "", true},
+		{"address of banned user", "", "10.0.0.2", true},
+		{"banned user under another name", "jonny", "10.0.0.2", true},
+		{"banned address", "bob", "10.0.0.3", true},
+		{"expired ban", "ann", "10.0.0.4", false},
+		{"someone else", "bob", "10.0.0.4", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if banned := l.Banned(tt.user, tt.ip); banned != tt.banned {
+				t.Errorf("expected banned=%v, got %v", tt.banned, banned)
+			}
+		})
+	}
+
+	if ok, err := l.Remove("jon"); !ok || err != nil {
+		t.Fatalf("expected jon to be unbanned, got ok=%v, err=%v", ok, err)
+	}
+	if ok, _ := l.Remove("ann"); ok {
+		t.Error("expected expired ban not to be removed")
+	}
+	if l.Banned("jon", "10.0.0.2") {
+		t.Error("expected jon and their address to be unbanned")
+	}
+}
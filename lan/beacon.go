@@ -0,0 +1,219 @@
+package lan
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/gob"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/MarcPer/lanchat/logger"
+)
+
+const beaconMagic = "lanchat"
+
+const defaultBeaconTimeout = time.Second
+
+// Announcer is implemented by discovery mechanisms in which the host
+// advertises itself, rather than just waiting for connections
+type Announcer interface {
+	Announce(ctx context.Context, port int) error
+}
+
+// probe is broadcast by peers looking for a host
+type probe struct {
+	Magic   string
+	Network string
+	Nonce   []byte
+}
+
+// beacon is sent by the host in response to a probe
+type beacon struct {
+	Magic   string
+	Network string
+	Version int
+	Port    int
+	Proof   []byte // proof of knowledge of the room key, for the probe's nonce
+}
+
+const proofBeacon = "lanchat-beacon"
+
+// BeaconScanner finds hosts by broadcasting a UDP probe to the chat port,
+// which hosts answer with a beacon. This is much faster than dialing every
+// address in the network. If no host answers, the Fallback scanner is used.
+type BeaconScanner struct {
+	Local      bool
+	Network    string // name of the chat network; hosts of other networks are ignored
+	RoomKey    string // hosts not knowing the same key are ignored
+	Interfaces InterfaceFilter
+	Timeout    time.Duration // time to wait for beacons
+	Fallback   NetScanner
+}
+
+func (s *BeaconScanner) FindHost(port int) (string, bool) {
+	if url, ok, _ := s.probe(port, s.probeAddrs(port)); ok {
+		return url, true
+	}
+	if s.Fallback == nil {
+		return "", false
+	}
+	logger.Debugf("no beacon received; falling back to scanning\n")
+	url, ok := s.Fallback.FindHost(port)
+	if !ok {
+		return "", false
+	}
+	// scanning finds hosts of any chat, so the one found is probed
+	// directly, in case the broadcast probe didn't reach it. If it doesn't
+	// answer either, the handshake tells whether it belongs to this chat.
+	addr, err := net.ResolveUDPAddr("udp", url)
+	if err != nil {
+		return url, true
+	}
+	if _, ok, other := s.probe(port, []*net.UDPAddr{addr}); !ok && other {
+		logger.Debugf("ignoring host at %s, which belongs to another chat\n", url)
+		return "", false
+	}
+	return url, true
+}
+
+// probe sends a probe to each of the given addresses, returning the address
+// of the first host of this chat answering. If none does, it returns whether
+// hosts of other chats did.
+func (s *BeaconScanner) probe(port int, dsts []*net.UDPAddr) (url string, found, other bool) {
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		logger.Errorf("FindHost: %v\n", err)
+		return "", false, false
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	nonce := newNonce()
+	if err := gob.NewEncoder(&buf).Encode(probe{Magic: beaconMagic, Network: s.Network, Nonce: nonce}); err != nil {
+		logger.Errorf("FindHost: %v\n", err)
+		return "", false, false
+	}
+	for _, dst := range dsts {
+		if _, err := conn.WriteTo(buf.Bytes(), dst); err != nil {
+			logger.Debugf("probe to %v: %v\n", dst, err)
+		}
+	}
+
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = defaultBeaconTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	data := make([]byte, 1024)
+	for {
+		n, from, err := conn.ReadFrom(data)
+		if err != nil {
+			logger.Debugf("waiting for beacons: %v\n", err)
+			return "", false, other
+		}
+		var b beacon
+		if err := gob.NewDecoder(bytes.NewReader(data[:n])).Decode(&b); err != nil || b.Magic != beaconMagic {
+			logger.Debugf("invalid beacon from %v\n", from)
+			continue
+		}
+		if b.Network != s.Network {
+			logger.Debugf("ignoring host of network %q at %v\n", b.Network, from)
+			other = true
+			continue
+		}
+		if b.Version != ProtocolVersion {
+			logger.Warnf("ignoring host at %v, running protocol version %d (expected %d)\n", from, b.Version, ProtocolVersion)
+			other = true
+			continue
+		}
+		if !hmac.Equal(b.Proof, roomProof(s.RoomKey, proofBeacon, nonce, nil)) {
+			logger.Debugf("ignoring host at %v, using another room key\n", from)
+			other = true
+			continue
+		}
+		addr := from.(*net.UDPAddr)
+		ip := addr.IP.String()
+		if addr.Zone != "" {
+			ip += "%" + addr.Zone
+		}
+		return net.JoinHostPort(ip, strconv.Itoa(b.Port)), true, other
+	}
+}
+
+// probeAddrs returns the addresses probes are sent to: the broadcast
+// address of each IPv4 network, and the all-nodes multicast address of each
+// interface with IPv6 link-local addresses
+func (s *BeaconScanner) probeAddrs(port int) []*net.UDPAddr {
+	out := []*net.UDPAddr{{IP: net.IPv4bcast, Port: port}}
+	if s.Local {
+		out = append(out, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	}
+	targets, err := findTargets(s.Interfaces)
+	if err != nil {
+		logger.Errorf("FindHost: %v\n", err)
+		return out
+	}
+	seen := make(map[string]bool)
+	for _, t := range targets {
+		_, ipnet, err := net.ParseCIDR(t.netIP)
+		if err != nil {
+			continue
+		}
+		var dst *net.UDPAddr
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			ip := make(net.IP, net.IPv4len)
+			for i, b := range ip4 {
+				ip[i] = b | ^ipnet.Mask[i]
+			}
+			dst = &net.UDPAddr{IP: ip, Port: port}
+		} else {
+			dst = &net.UDPAddr{IP: net.IPv6linklocalallnodes, Port: port, Zone: t.zone}
+		}
+		if !seen[dst.String()] {
+			seen[dst.String()] = true
+			out = append(out, dst)
+		}
+	}
+	return out
+}
+
+// Announce answers probes sent to the given UDP port, until ctx is cancelled
+func (s *BeaconScanner) Announce(ctx context.Context, port int) error {
+	conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	go func() {
+		data := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFrom(data)
+			if err != nil {
+				logger.Debugf("Announce: %v\n", err)
+				return
+			}
+			var p probe
+			if err := gob.NewDecoder(bytes.NewReader(data[:n])).Decode(&p); err != nil || p.Magic != beaconMagic {
+				logger.Debugf("invalid probe from %v\n", from)
+				continue
+			}
+			logger.Debugf("probe from %v\n", from)
+			var buf bytes.Buffer
+			b := beacon{Magic: beaconMagic, Network: s.Network, Version: ProtocolVersion, Port: port, Proof: roomProof(s.RoomKey, proofBeacon, p.Nonce, nil)}
+			if err := gob.NewEncoder(&buf).Encode(b); err != nil {
+				logger.Debugf("Announce: %v\n", err)
+				continue
+			}
+			if _, err := conn.WriteTo(buf.Bytes(), from); err != nil {
+				logger.Debugf("Announce: %v\n", err)
+			}
+		}
+	}()
+	return nil
+}
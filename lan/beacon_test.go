@@ -0,0 +1,73 @@
+package lan
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type fixedScanner struct {
+	url string
+}
+
+func (s *fixedScanner) FindHost(port int) (string, bool) {
+	return s.url, s.url != ""
+}
+
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestBeaconScanner(t *testing.T) {
+	tests := []struct {
+		name        string
+		hostNetwork string
+		hostKey     string
+		fallback    NetScanner
+		url         string
+		found       bool
+	}{
+		{"host in same network", "office", "secret", nil, "", true},
+		{"host in other network", "other", "secret", nil, "", false},
+		{"host with other room key", "office", "public", nil, "", false},
+		{"host in other network, with fallback", "other", "secret", &fixedScanner{"local"}, "", false},
+		{"host with other room key, with fallback", "office", "public", &fixedScanner{"local"}, "", false},
+		{"silent host, with fallback", "other", "secret", &fixedScanner{"10.0.0.1:6776"}, "10.0.0.1:6776", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := freeUDPPort(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			host := &BeaconScanner{Network: tt.hostNetwork, RoomKey: tt.hostKey}
+			if err := host.Announce(ctx, port); err != nil {
+				t.Fatal(err)
+			}
+
+			if f, ok := tt.fallback.(*fixedScanner); ok && f.url == "local" {
+				// the fallback finds the host which announced itself
+				tt.fallback = &fixedScanner{"127.0.0.1:" + strconv.Itoa(port)}
+			}
+			s := &BeaconScanner{Local: true, Network: "office", RoomKey: "secret", Timeout: 300 * time.Millisecond, Fallback: tt.fallback}
+			url, found := s.FindHost(port)
+			if found != tt.found {
+				t.Fatalf("expected found=%v, got %v", tt.found, found)
+			}
+			if tt.url == "" && found {
+				// the host may answer on any of the local addresses
+				if _, p, _ := net.SplitHostPort(url); p != strconv.Itoa(port) {
+					t.Errorf("expected host at port %d, got %q", port, url)
+				}
+			} else if url != tt.url {
+				t.Errorf("expected url=%q, got %q", tt.url, url)
+			}
+		})
+	}
+}
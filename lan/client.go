@@ -2,15 +2,19 @@ package lan
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MarcPer/lanchat/logger"
+	"github.com/MarcPer/lanchat/store"
 	"github.com/MarcPer/lanchat/ui"
 )
 
@@ -25,31 +29,136 @@ const (
 	MsgTypeCmd
 	MsgTypeAdmin
 	MsgTypePing
+	MsgTypeMembers
+	MsgTypeHello
+	MsgTypeWelcome
+	MsgTypeReject
+	MsgTypeChallenge
+	MsgTypeAuth
+	MsgTypePrivate
+	MsgTypeHistory
+	MsgTypeAck  // sent back to the sender of a message once it is received
+	MsgTypeRead // sent back to the sender of a message once the user has seen it
+	MsgTypePong // answer to MsgTypePing, with the same sequence number
+	MsgTypeFileOffer
+	MsgTypeFileAccept
+	MsgTypeFileReject
+	MsgTypeFileChunk
+	MsgTypePresence
+	MsgTypeWho    // asks the host for the roster
+	MsgTypeRoster // answer to MsgTypeWho
+	MsgTypeName   // assigns a name to a peer whose own is taken
+	MsgTypeKick   // tells peers the host disconnected someone, for them to do the same
+	MsgTypeMute   // tells peers to discard the messages of someone
+	MsgTypeUnmute // reverts MsgTypeMute
+	MsgTypeTyping // sent while the user types a chat message
 )
 
+// time to wait before scanning for hosts again, after failing to connect, in milliseconds
+const retryDelay = 1000
+
 type Packet struct {
-	User string
-	Msg  string
-	Type int
+	User     string
+	Msg      string
+	Type     int
+	ID       string        // unique message ID, used to discard duplicates reaching a peer through more than one path
+	Peers    []PeerInfo    // sent with MsgTypeWelcome and MsgTypeMembers; the first entry always describes the sender
+	Hello    *Hello        // sent with MsgTypeHello and MsgTypeWelcome, and with MsgTypeReject to peers of other networks, holding the network only
+	Auth     *Auth         // sent with MsgTypeHello, MsgTypeChallenge and MsgTypeAuth
+	Room     string        // room chat messages are sent to; only peers in it receive them
+	To       string        // recipient of private messages
+	Ref      string        // ID of the message acknowledged by MsgTypeAck and MsgTypeRead
+	Seq      uint64        // sequence number of MsgTypePing, echoed by MsgTypePong
+	File     *File         // sent with MsgTypeFileOffer, MsgTypeFileAccept, MsgTypeFileReject and MsgTypeFileChunk
+	Presence *Presence     // sent with MsgTypePresence
+	Roster   []RosterEntry // sent with MsgTypeRoster
+	Name     string        // name assigned by the host, sent with MsgTypeWelcome and MsgTypeName
+	Key      []byte        // public identity key of the sender of a chat message; see Identity
+	Sig      []byte        // signature of a chat message, made with the identity key of its sender
+	Target   *PeerInfo     // peer kicked or muted, sent with MsgTypeKick, MsgTypeMute and MsgTypeUnmute
+	Clock    uint64        // Lamport timestamp of the sender when the message was sent, ordering messages across the mesh
+	Time     time.Time     // wall clock time of the sender when the message was sent
+}
+
+// PeerInfo describes a member of the chat mesh, so that peers can connect to
+// each other directly, not only to the host.
+type PeerInfo struct {
+	ID    string
+	Name  string
+	Addr  string // address where the peer accepts connections. When the host part is empty, the IP of the connection it came from is used
+	Role  Role
+	Key   string // fingerprint of the identity key the peer proved to hold, if it has one
+	Muted bool   // whether the host muted the peer
 }
 
 type peer struct {
-	name string
-	conn io.Reader
-	enc  *gob.Encoder
+	id          string
+	name        string
+	addr        string
+	caps        []string
+	rooms       map[string]bool
+	fingerprint string              // of the peer's TLS certificate
+	key         []byte              // public identity key presented in the handshake
+	host        bool                // whether this is the connection to the chat host
+	lastSeen    time.Time           // when the last packet was received from the peer
+	rtt         time.Duration       // round-trip time of the last ping answered
+	pings       map[uint64]sentPing // pings not answered yet, by sequence number
+	presence    Presence
+	client      string    // lanchat version
+	since       time.Time // when the connection was established
+	conn        io.Reader
+	enc         *gob.Encoder
+	dec         *gob.Decoder
 }
 
 type Client struct {
-	Name     string
-	HostPort int
-	ToUI     chan ui.Packet
-	FromUI   chan ui.Packet
-	Scanner  NetScanner
-	host     bool
-	peers    map[peerID]*peer
-	ctx      context.Context
-	cancel   context.CancelFunc
-	restart  chan int
+	Name           string
+	HostPort       int
+	ToUI           chan ui.Packet
+	FromUI         chan ui.Packet
+	Network        string // name of the chat network; peers of other networks are rejected
+	RoomKey        string // key peers must prove to know in order to connect
+	Scanner        NetScanner
+	Announcer      Announcer    // if set, used to advertise the chat while hosting
+	TLS            *tls.Config  // if set, connections between peers are encrypted
+	KnownPeers     *KnownPeers  // fingerprints of peers seen before, checked on encrypted connections
+	Identity       *Identity    // if set, chat messages are signed, and those received are verified
+	TrustedKeys    *KnownPeers  // fingerprints of identity keys pinned with :trust
+	Bans           *BanList     // if set, users and addresses banned with :ban are refused
+	Ignored        *IgnoreList  // if set, messages of users ignored with :ignore are hidden
+	HistorySize    int          // number of chat messages replayed to peers joining later; 0 disables history
+	Store          *store.Store // if set, chat messages are saved to disk
+	LogReplay      int          // number of saved messages shown per room on start
+	DownloadDir    string       // where files received from peers are saved
+	MaxMissedPings int          // number of pings in a row a peer may leave unanswered before being disconnected; 0 disables it
+	host           bool
+	id             string // random node ID, identifying this client among peers
+	port           int    // port where the client accepts connections from peers
+	peers          map[peerID]*peer
+	members        []PeerInfo // all peers in the chat, as last distributed by the host
+	rooms          map[string]bool
+	room           string // active room, which messages are sent to
+	lastPrivate    string // sender of the last private message received
+	seen           dedup
+	history        *history
+	receipts       receipts
+	online         bool     // whether connected to a host, or hosting
+	queue          []Packet // messages sent while offline
+	files          transfers
+	presence       Presence
+	autoAway       bool      // whether presence was set automatically, when the user stopped typing
+	since          time.Time // when this client connected to the host, or started hosting
+	clock          uint64    // Lamport clock, advanced on every message sent and received
+	pingSeq        uint64
+	changed        chan struct{}   // signals that the peer list shown by the UI is outdated
+	muted          map[string]bool // node IDs of peers muted by the host
+	kicked         bool            // whether the host kicked this client out of the chat
+	askedWho       bool            // whether the roster was asked from the host, and not received yet
+	roles          map[string]Role // operators named by the host, by fingerprint of their identity key
+	ctx            context.Context
+	runCtx         context.Context
+	cancel         context.CancelFunc
+	restart        chan int
 }
 
 func (c *Client) Start(ctx context.Context) {
@@ -57,39 +166,149 @@ func (c *Client) Start(ctx context.Context) {
 		c.ctx = ctx
 	}
 	c.restart = make(chan int)
+	if c.id == "" {
+		c.id = newNodeID()
+	}
+	c.history = newHistory(c.HistorySize)
+	c.presence = Presence{Status: PresenceOnline}
+	c.changed = make(chan struct{}, 1)
 	go c.monitor()
-	c.retry(0)
+	go c.updatePeerList(c.ctx)
+	// messages typed while looking for a host are queued, so the UI is
+	// handled independently of each run
+	go c.handleUIPackets(c.ctx)
+	go func() {
+		// the UI only starts reading packets after this returns
+		c.replayLog(DefaultRoom)
+		c.retry(0)
+	}()
 }
 
 func (c *Client) run(ctx context.Context) {
+	peersMu.Lock()
 	c.peers = make(map[peerID]*peer)
+	c.members = nil
+	c.roles = nil
+	c.runCtx = ctx
+	c.online = false
+	peersMu.Unlock()
 	c.logToUIf("Scanning for hosts")
 	host, found := c.Scanner.FindHost(c.HostPort)
 	c.host = !found
 	if found { // host found, so become regular peer
 		c.logToUIf("Found host at %s; connecting...", host)
-		conn, err := net.Dial("tcp", host)
-		if err != nil {
+		// peers accept connections on a random port, so that others in the mesh can reach them
+		if err := c.serve(ctx, 0); err != nil {
+			logger.Errorf("Could not start listener: %v\n", err)
+			c.retry(retryDelay)
+			return
+		}
+		err := c.connect(PeerInfo{Addr: host}, true)
+		if _, other := err.(errOtherChat); other {
+			// trying again would find the same host
+			c.logToUIf("The host at %s belongs to another chat (%v)", host, err)
+			found = false
+			c.host = true
+		} else if err != nil {
 			logger.Errorf("Could not connect to host: %v\n", err)
-			c.retry(-1)
+			c.retry(retryDelay)
+			return
+		}
+	}
+	if !found { // become a host
+		c.logToUIf("No host found; starting server at 0.0.0.0:%d ...", c.HostPort)
+		if err := c.serve(ctx, c.HostPort); err != nil {
+			logger.Errorf("Could not start server: %v\n", err)
+			c.retry(retryDelay)
 			return
 		}
-		var pid peerID = peerID(conn.RemoteAddr().String())
-		enc := gob.NewEncoder(conn)
+		c.announce(ctx)
 		peersMu.Lock()
-		c.peers[pid] = &peer{conn: conn, enc: enc}
+		c.online = true
+		c.since = time.Now()
+		c.peersChanged()
 		peersMu.Unlock()
-		c.transmit(Packet{User: "", Type: MsgTypeCmd, Msg: ":id " + c.Name}, pid)
-		go c.handleConn(pid)
-	} else { // become a host
-		c.logToUIf("No host found; starting server at 0.0.0.0:%d ...", c.HostPort)
-		go c.serve(ctx)
+		c.flush()
 	}
 
-	go c.handleUIPackets(ctx)
 	go c.ping(ctx)
 }
 
+// connect dials a peer and introduces this client to it. If host is true,
+// the peer answers with the list of all other peers, which are then
+// connected to as well.
+func (c *Client) connect(info PeerInfo, host bool) error {
+	conn, err := net.DialTimeout("tcp", info.Addr, handshakeTimeout)
+	if err != nil {
+		return err
+	}
+	p, members, err := c.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	// members are listed by the host, which checked their identity key
+	if info.ID != "" && (p.id != info.ID || keyFingerprint(p.key) != info.Key) {
+		conn.Close()
+		return fmt.Errorf("the peer at %s is not the member listed by the host", info.Addr)
+	}
+	p.addr = info.Addr
+	p.host = host
+	var pid peerID = peerID(conn.RemoteAddr().String())
+	peersMu.Lock()
+	c.peers[pid] = p
+	if host {
+		c.online = true
+		c.since = time.Now()
+		// until the host sends the full list, the one it welcomed this
+		// client with is enough to elect the next host
+		c.members = members
+		c.muted = mutedMembers(members)
+	}
+	c.connectAll(members)
+	c.peersChanged()
+	peersMu.Unlock()
+	c.logToUIf("user \"%s\" connected", p.name)
+	go c.handleConn(pid)
+	if host {
+		c.flush()
+	}
+	return nil
+}
+
+// attempts at connecting to each member listed by the host, and the delay
+// between them
+const (
+	meshAttempts   = 3
+	meshRetryDelay = 500 * time.Millisecond
+)
+
+// connectAll connects to the given peers, unless already connected to them.
+// Callers must hold peersMu.
+func (c *Client) connectAll(members []PeerInfo) {
+	for _, info := range members {
+		if info.ID == c.id || c.connectedTo(info.ID) {
+			continue
+		}
+		go func(info PeerInfo) {
+			var err error
+			// peers only accept those listed by the host, which may not
+			// have sent them the list including this client yet
+			for i := 0; i < meshAttempts; i++ {
+				if err = c.connect(info, false); err == nil {
+					return
+				}
+				time.Sleep(meshRetryDelay)
+			}
+			logger.Warnf("could not connect to peer %s at %s: %v\n", info.Name, info.Addr, err)
+		}(info)
+	}
+}
+
+func (c *Client) self() PeerInfo {
+	return PeerInfo{ID: c.id, Name: c.Name, Addr: fmt.Sprintf(":%d", c.port), Role: c.roleOf(c.id), Key: keyFingerprint(c.publicKey())}
+}
+
 func (c *Client) monitor() {
 	for {
 		select {
@@ -104,11 +323,6 @@ func (c *Client) monitor() {
 			c.host = true // this prevents disconnections from triggering another, possibly concurrent, restart
 			// check the cleanPeer method to understand why.
 
-			// Wait a random time before starting again, to avoid two peers
-			// trying to become a host simultaneously
-			// A more reliable scheme should be used, in which peers
-			// know about the existence of others, not just the host.
-			// They can then coordinate better in such cases.
 			time.Sleep(time.Duration(t) * time.Millisecond)
 			go c.run(subCtx)
 		}
@@ -116,22 +330,135 @@ func (c *Client) monitor() {
 }
 
 // takes time to wait before restarting, in milliseconds
-// if < 0, sets it to be a random value
 func (c *Client) retry(t int) {
-	if t < 0 {
-		t = rand.Intn(8000)
-	}
 	c.restart <- t
 }
 
-func (c *Client) serve(ctx context.Context) {
-	url := fmt.Sprintf(":%d", c.HostPort)
+// rejoin connects to the host again after losing the link to it. The link
+// may have been lost on this end only, e.g. after a network glitch, or the
+// host evicting this client for missing pings, while the host is still up
+// for everyone else; electing a new host right away would split the chat
+// in two. A new host is only elected once the old one can't be reached.
+func (c *Client) rejoin(host *peer) {
+	c.logToUIf("lost the connection to the host '%s'; reconnecting", host.name)
+	info := PeerInfo{ID: host.id, Name: host.name, Addr: host.addr, Key: keyFingerprint(host.key)}
+	var err error
+	for i := 0; i < meshAttempts; i++ {
+		if err = c.connect(info, true); err == nil {
+			return
+		}
+		time.Sleep(meshRetryDelay)
+	}
+	logger.Warnf("could not reconnect to host %s at %s: %v\n", host.name, host.addr, err)
+	peersMu.Lock()
+	defer peersMu.Unlock()
+	if c.host || c.kicked {
+		return
+	}
+	c.elect(host.id)
+}
+
+// elect picks a new host once the current one, with the given node ID, is
+// gone. Since the host distributes the member list to everyone, all peers
+// agree on the winner: the first remaining member in it. The host lists
+// members in the order they joined, so the longest-standing one takes over,
+// which no one can claim by picking their node ID. Without a list, the
+// connected peer with the lowest node ID wins, so that peers at least agree
+// with each other, since everyone is connected to everyone else. Callers
+// must hold peersMu.
+func (c *Client) elect(gone string) {
+	members := make([]PeerInfo, 0, len(c.members))
+	for _, m := range c.members {
+		if m.ID != gone {
+			members = append(members, m)
+		}
+	}
+	c.members = members
+
+	var winner PeerInfo
+	if len(c.members) > 0 {
+		winner = c.members[0]
+	} else {
+		winner = c.self()
+		for _, p := range c.peers {
+			if p.id != gone && p.id < winner.ID {
+				winner = PeerInfo{ID: p.id, Name: p.name, Addr: p.addr}
+			}
+		}
+	}
+	if winner.ID == c.id {
+		c.becomeHost()
+		return
+	}
+	for _, p := range c.peers {
+		if p.id == winner.ID {
+			p.host = true
+			c.peersChanged()
+			c.logToUIf("'%s' is the new host", p.name)
+			return
+		}
+	}
+	// the winner is known from the member list only; if it can't be
+	// reached, it is gone as well
+	go func() {
+		if err := c.connect(winner, true); err != nil {
+			logger.Warnf("could not connect to new host %s at %s: %v\n", winner.Name, winner.Addr, err)
+			peersMu.Lock()
+			c.elect(winner.ID)
+			peersMu.Unlock()
+		}
+	}()
+}
+
+// becomeHost starts accepting connections on the host port, so that new
+// peers can find the chat. If the port can't be listened on, e.g. since the
+// old host still holds it, this client steps down and looks for a host
+// again. Callers must hold peersMu.
+func (c *Client) becomeHost() {
+	c.host = true
+	c.peersChanged()
+	c.sendMembers()
+	ctx := c.runCtx
+	go func() {
+		if err := c.serve(ctx, c.HostPort); err != nil {
+			logger.Errorf("Could not start server: %v\n", err)
+			c.logToUIf("Host left, but hosting failed (%v); looking for a host again", err)
+			c.retry(retryDelay)
+			return
+		}
+		c.logToUIf("Host left; now hosting at 0.0.0.0:%d", c.HostPort)
+		c.announce(ctx)
+		c.flush()
+	}()
+}
+
+func (c *Client) announce(ctx context.Context) {
+	if c.Announcer == nil {
+		return
+	}
+	if err := c.Announcer.Announce(ctx, c.HostPort); err != nil {
+		logger.Warnf("Could not announce host: %v\n", err)
+	}
+}
+
+// sendMembers distributes the list of all members to every peer, for them to
+// agree on a new host if the current one leaves. Callers must hold peersMu.
+func (c *Client) sendMembers() {
+	if !c.host {
+		return
+	}
+	c.sendAll(Packet{Type: MsgTypeMembers, Peers: c.memberList("")}, "")
+}
+
+// serve accepts connections on the given port (a random one, if 0) until
+// ctx is cancelled
+func (c *Client) serve(ctx context.Context, port int) error {
+	url := fmt.Sprintf(":%d", port)
 	ln, err := net.Listen("tcp", url)
 	if err != nil {
-		logger.Errorf("Could not start server: %v\n", err)
-		c.retry(-1)
-		return
+		return err
 	}
+	c.port = ln.Addr().(*net.TCPAddr).Port
 
 	connCh := make(chan net.Conn)
 
@@ -148,20 +475,23 @@ func (c *Client) serve(ctx context.Context) {
 		}
 	}(ln, connCh)
 
-	for {
-		select {
-		case conn := <-connCh:
-			var pid peerID = peerID(conn.RemoteAddr().String())
-			peersMu.Lock()
-			enc := gob.NewEncoder(conn)
-			c.peers[pid] = &peer{conn: conn, enc: enc}
-			peersMu.Unlock()
-			go c.handleConn(pid)
-		case <-ctx.Done():
-			ln.Close()
-			return
+	go func() {
+		for {
+			select {
+			case conn := <-connCh:
+				if c.banned(conn.RemoteAddr()) {
+					c.logToUIf("rejected connection from %s: banned", conn.RemoteAddr())
+					conn.Close()
+					continue
+				}
+				go c.accept(conn)
+			case <-ctx.Done():
+				ln.Close()
+				return
+			}
 		}
-	}
+	}()
+	return nil
 }
 
 func (c *Client) handleConn(pid peerID) {
@@ -172,24 +502,29 @@ func (c *Client) handleConn(pid peerID) {
 		logger.Debugf("handleConn: peer with ID=%v not found\n", pid)
 		return
 	}
-	dec := gob.NewDecoder(peer.conn)
+	dec := peer.dec
+	if dec == nil {
+		dec = gob.NewDecoder(peer.conn)
+	}
 	for {
 		var pkt Packet
 		err := dec.Decode(&pkt)
-		if err == io.EOF {
+		if err != nil {
+			if err != io.EOF {
+				logger.Debugf("handleConn: error decoding packet %v\n", err)
+			}
+			// every peer holds its own connection to the one leaving, so
+			// there is no need to tell others about it
 			if peer.name != "" {
-				msg := fmt.Sprintf("'%s' disconnected\n", peer.name)
-				c.logToUI(msg)
-				c.broadcast(Packet{Msg: msg, Type: MsgTypeAdmin}, pid)
+				c.logToUIf("'%s' disconnected\n", peer.name)
 			}
 			c.cleanPeer(pid)
 			return
-		} else if err != nil {
-			logger.Errorf("handleConn: error decoding packet %v\n", err)
-			// return
-		} else {
-			handleInbound(c, pkt, pid)
 		}
+		peersMu.Lock()
+		peer.lastSeen = time.Now()
+		peersMu.Unlock()
+		handleInbound(c, pkt, pid)
 	}
 }
 
@@ -205,30 +540,21 @@ func (c *Client) handleUIPackets(ctx context.Context) {
 	}
 }
 
-var pingPacket = Packet{Type: MsgTypePing}
-
-func (c *Client) ping(ctx context.Context) {
-	ticker := time.NewTicker(3 * time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			c.broadcast(pingPacket, "")
-		case <-ctx.Done():
-			return
-		}
-	}
-}
-
 func (c *Client) broadcast(pkt Packet, except peerID) {
 	peersMu.RLock()
-	for pid := range c.peers {
-		if pid == except {
+	c.sendAll(pkt, except)
+	peersMu.RUnlock()
+}
+
+// sendAll is like broadcast, for callers already holding peersMu. Chat
+// messages are only sent to peers in the room they belong to.
+func (c *Client) sendAll(pkt Packet, except peerID) {
+	for pid, peer := range c.peers {
+		if pid == except || !inRoom(peer.rooms, pkt.Room) {
 			continue
 		}
 		c.transmit(pkt, pid)
 	}
-	peersMu.RUnlock()
 }
 
 func (c *Client) transmit(pkt Packet, pid peerID) {
@@ -237,21 +563,104 @@ func (c *Client) transmit(pkt Packet, pid peerID) {
 		logger.Warnf("transmit: peer with ID=%v not found\n", pid)
 		return
 	}
-	if err := peer.enc.Encode(pkt); err != nil {
+	if err := peer.send(pkt); err != nil {
 		logger.Errorf("transmit: error encoding packet %v\n", err)
-		// failed to send data to peer
-		c.cleanPeer(pid)
+		// failed to send data to peer. Callers usually hold peersMu, so
+		// the cleanup must not block on it.
+		go c.cleanPeer(pid)
 	}
 }
 
+// writeTimeout bounds how long sending a packet to a peer may take. Packets
+// are mostly sent while holding peersMu, so a peer which stopped reading
+// would otherwise hold up the whole chat; it is disconnected instead.
+const writeTimeout = 5 * time.Second
+
+// send encodes pkt over the connection to p, giving up after writeTimeout
+func (p *peer) send(pkt Packet) error {
+	if conn, ok := p.conn.(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	return p.enc.Encode(pkt)
+}
+
+// cleanPeer forgets about a peer and closes its connection. Losing a single
+// link is fine, since all peers are connected to each other; if the host is
+// lost, a new one is elected among the remaining peers.
 func (c *Client) cleanPeer(pid peerID) {
 	peersMu.Lock()
 	defer peersMu.Unlock()
+	peer, ok := c.peers[pid]
+	if !ok {
+		return
+	}
 	delete(c.peers, pid)
+	c.peersChanged()
+	if closer, ok := peer.conn.(io.Closer); ok {
+		closer.Close()
+	}
+	c.dropDownloads(peer)
+	c.dropRole(peer)
+	if c.kicked {
+		return
+	}
+
+	if c.host {
+		c.sendMembers()
+	} else if peer.host {
+		go c.rejoin(peer)
+	} else if len(c.peers) < 1 {
+		c.online = false
+		c.retry(0)
+	}
+}
+
+// fromHost returns whether the connection with the given ID leads to the
+// host
+func (c *Client) fromHost(from peerID) bool {
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	peer, ok := c.peers[from]
+	return ok && peer.host
+}
+
+// connectedTo returns whether there is a link to the peer with the given
+// node ID. Callers must hold peersMu.
+func (c *Client) connectedTo(id string) bool {
+	for _, p := range c.peers {
+		if p.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// stamp assigns p a message ID, unique across the mesh, along with the
+// current Lamport and wall clock times. The ID is marked as seen, so that
+// the message is discarded if it comes back through another peer.
+func (c *Client) stamp(p *Packet) {
+	p.Clock = atomic.AddUint64(&c.clock, 1)
+	p.ID = fmt.Sprintf("%s-%d", c.id, p.Clock)
+	p.Time = time.Now()
+	c.seen.check(p.ID)
+}
+
+// observe advances the Lamport clock past that of a received message
+func (c *Client) observe(clock uint64) {
+	for {
+		cur := atomic.LoadUint64(&c.clock)
+		if clock <= cur || atomic.CompareAndSwapUint64(&c.clock, cur, clock) {
+			return
+		}
+	}
+}
 
-	if !c.host && len(c.peers) < 1 {
-		c.retry(-1)
+func newNodeID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		logger.Errorf("newNodeID: %v\n", err)
 	}
+	return hex.EncodeToString(b)
 }
 
 func (c *Client) logToUI(msg string) {
@@ -0,0 +1,251 @@
+package lan
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestElect(t *testing.T) {
+	tests := []struct {
+		name      string
+		selfID    string
+		members   []PeerInfo
+		host      bool
+		hostPeers []bool
+	}{
+		{
+			"first member listed wins",
+			"m",
+			[]PeerInfo{{ID: "0host"}, {ID: "a"}, {ID: "m"}, {ID: "z"}},
+			false,
+			[]bool{true, false},
+		},
+		{
+			"self listed first wins",
+			"zz",
+			[]PeerInfo{{ID: "0host"}, {ID: "zz"}, {ID: "a"}, {ID: "z"}},
+			true,
+			[]bool{false, false},
+		},
+		{
+			"lower ID listed later loses",
+			"0",
+			[]PeerInfo{{ID: "0host"}, {ID: "z"}, {ID: "0"}, {ID: "a"}},
+			false,
+			[]bool{false, true},
+		},
+		{
+			"connected peer wins without member list",
+			"m",
+			[]PeerInfo{},
+			false,
+			[]bool{true, false},
+		},
+		{
+			"self wins among connected peers without member list",
+			"0",
+			[]PeerInfo{},
+			true,
+			[]bool{false, false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(false, 2, &NullScanner{})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c.runCtx = ctx
+			c.HostPort = 0
+			c.id = tt.selfID
+			c.members = tt.members
+			c.peers["0"].id = "a"
+			c.peers["1"].id = "z"
+
+			peersMu.Lock()
+			c.elect("0host")
+			peersMu.Unlock()
+
+			if c.host != tt.host {
+				t.Errorf("expected host=%v, got %v", tt.host, c.host)
+			}
+			for i, expected := range tt.hostPeers {
+				if got := c.peers[peerID(strconv.Itoa(i))].host; got != expected {
+					t.Errorf("expected peer_%d to have host=%v, got %v", i, expected, got)
+				}
+			}
+			for _, m := range c.members {
+				if m.ID == "0host" {
+					t.Errorf("expected departed host to be removed from members")
+				}
+			}
+		})
+	}
+}
+
+func TestMembersInHandler(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	c.peers["10.0.0.1:50000"] = c.peers["0"]
+	c.peers["10.0.0.1:50000"].host = true
+	delete(c.peers, "0")
+	handleInbound(&c, Packet{Type: MsgTypeMembers, Peers: []PeerInfo{
+		{ID: "h", Name: "host", Addr: ":6776"},
+		{ID: "p", Name: "peer", Addr: "10.0.0.5:4000"},
+	}}, "10.0.0.1:50000")
+	// lists from other members are dropped
+	handleInbound(&c, Packet{Type: MsgTypeMembers, Peers: []PeerInfo{
+		{ID: "testClientID", Name: "testClient", Role: RoleOwner},
+	}}, "1")
+
+	expected := []PeerInfo{
+		{ID: "h", Name: "host", Addr: "10.0.0.1:6776"},
+		{ID: "p", Name: "peer", Addr: "10.0.0.5:4000"},
+	}
+	if len(c.members) != len(expected) {
+		t.Fatalf("expected %d members, got %d", len(expected), len(c.members))
+	}
+	for i, m := range expected {
+		if c.members[i] != m {
+			t.Errorf("expected member %d to be %+v, got %+v", i, m, c.members[i])
+		}
+	}
+
+	// the host keeps its own list
+	h := newTestClient(true, 1, &NullScanner{})
+	handleInbound(&h, Packet{Type: MsgTypeMembers, Peers: []PeerInfo{
+		{ID: "peer_0", Name: "peer_0", Role: RoleOperator, Key: "k"},
+	}}, "0")
+	if len(h.members) != 0 || len(h.roles) != 0 {
+		t.Errorf("expected host to ignore member lists, got %+v and %+v", h.members, h.roles)
+	}
+}
+
+func TestLamportClock(t *testing.T) {
+	c := newTestClient(false, 1, &NullScanner{})
+	var first Packet
+	c.stamp(&first)
+	if first.Clock != 1 || first.ID != "testClientID-1" || first.Time.IsZero() {
+		t.Fatalf("expected first message to be stamped with clock 1, got %+v", first)
+	}
+	// messages from peers ahead of this client move its clock forward
+	handleInbound(&c, Packet{User: "peer_0", Msg: "hi", ID: "a-41", Clock: 41}, "0")
+	var next Packet
+	c.stamp(&next)
+	if next.Clock != 42 || next.ID != "testClientID-42" {
+		t.Errorf("expected clock to move past received message, got %d", next.Clock)
+	}
+	// but never back
+	handleInbound(&c, Packet{User: "peer_0", Msg: "hi", ID: "a-2", Clock: 2}, "0")
+	c.stamp(&next)
+	if next.Clock != 43 {
+		t.Errorf("expected clock to keep increasing, got %d", next.Clock)
+	}
+	if c.seen.check(first.ID) == false {
+		t.Errorf("expected stamped messages to be marked as seen")
+	}
+}
+
+func TestRejoinHost(t *testing.T) {
+	host := newTestClient(true, 0, &NullScanner{})
+	host.id = "hostID"
+	member := newTestClient(false, 1, &NullScanner{})
+	member.id = "memberID"
+	member.restart = make(chan int, 1)
+	var err error
+	if member.Identity, err = LoadIdentity(tempDir(t)); err != nil {
+		t.Fatal(err)
+	}
+	member.members = []PeerInfo{{ID: "hostID"}, {ID: "memberID"}}
+	// the host didn't notice the member's link dropped yet
+	var buf bytes.Buffer
+	host.peers["old"] = &peer{id: "memberID", name: "testClient", key: member.publicKey(), conn: &buf, enc: gob.NewEncoder(&buf)}
+	member.peers["0"].id = "hostID"
+	member.peers["0"].host = true
+	member.peers["0"].addr = listen(t, &host)
+
+	member.cleanPeer("0")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		peersMu.RLock()
+		rejoined := len(member.peers) == 1 && len(host.peers) == 1 && host.peers["old"] == nil
+		for _, p := range member.peers {
+			rejoined = rejoined && p.host && p.id == "hostID"
+		}
+		isHost := member.host
+		peersMu.RUnlock()
+		if isHost {
+			t.Fatal("expected member to reconnect to the host, not to take over")
+		}
+		if rejoined {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected member to reconnect to the host")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// once the host can't be reached, a new one is elected
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	member.runCtx = ctx
+	member.HostPort = 0
+	var hostLink peerID
+	peersMu.Lock()
+	for pid, p := range member.peers {
+		p.addr = ln.Addr().String()
+		hostLink = pid
+	}
+	peersMu.Unlock()
+	member.cleanPeer(hostLink)
+	deadline = time.Now().Add(3 * time.Second)
+	for {
+		peersMu.RLock()
+		isHost := member.host
+		peersMu.RUnlock()
+		if isHost {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected member to take over once the host is gone")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBecomeHostFails(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c := newTestClient(false, 1, &NullScanner{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.runCtx = ctx
+	c.HostPort = ln.Addr().(*net.TCPAddr).Port
+	c.restart = make(chan int, 1)
+	c.id = "0"
+	c.peers["0"].id = "a"
+
+	peersMu.Lock()
+	c.elect("0host")
+	peersMu.Unlock()
+
+	select {
+	case <-c.restart:
+	case <-time.After(time.Second):
+		t.Fatal("expected client to look for a host again once the host port is taken")
+	}
+}
@@ -0,0 +1,38 @@
+package lan
+
+import "sync"
+
+const dedupSize = 1024
+
+// dedup remembers the most recent message IDs, so that packets reaching a
+// peer through more than one path are only processed once
+type dedup struct {
+	mu   sync.Mutex
+	ids  map[string]bool
+	ring []string
+	next int
+}
+
+// check records id and returns whether it had been seen before. Empty IDs
+// are never considered duplicates.
+func (d *dedup) check(id string) bool {
+	if id == "" {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ids == nil {
+		d.ids = make(map[string]bool, dedupSize)
+		d.ring = make([]string, dedupSize)
+	}
+	if d.ids[id] {
+		return true
+	}
+	if old := d.ring[d.next]; old != "" {
+		delete(d.ids, old)
+	}
+	d.ring[d.next] = id
+	d.next = (d.next + 1) % dedupSize
+	d.ids[id] = true
+	return false
+}
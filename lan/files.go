@@ -0,0 +1,458 @@
+package lan
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+// size of the chunks files are sent in
+const fileChunkSize = 32 * 1024
+
+// File describes a file offered to peers with MsgTypeFileOffer, or carries
+// a chunk of it with MsgTypeFileChunk
+type File struct {
+	ID     string // transfer ID; that of the offer packet
+	Name   string
+	Size   int64
+	SHA256 string // hex-encoded checksum of the whole file
+	Offset int64  // position of Data in the file
+	Data   []byte // chunk of the file; an empty chunk marks its end
+}
+
+// upload is a file offered by this client
+type upload struct {
+	path string
+	file File
+}
+
+// download is a file offered to this client
+type download struct {
+	from     string
+	file     File
+	accepted bool
+	part     *os.File // where the file is written to, until it is complete
+	hash     hash.Hash
+	received int64
+}
+
+// downloadKey tells downloads apart: transfer IDs are chosen by senders, so
+// they are only unique per sender
+type downloadKey struct {
+	from, id string
+}
+
+func (d *download) key() downloadKey {
+	return downloadKey{d.from, d.file.ID}
+}
+
+// transfers keeps track of files offered by and to this client
+type transfers struct {
+	mu        sync.Mutex
+	uploads   map[string]*upload
+	downloads map[downloadKey]*download
+	offers    []*download // downloads neither accepted nor rejected yet, oldest first
+}
+
+// sendOutHandler offers a file to a user, or to everyone
+func sendOutHandler(c *Client, p ui.Packet) {
+	args := strings.SplitN(p.Msg, " ", 3)
+	if len(args) != 3 || args[1] == "" || strings.TrimSpace(args[2]) == "" {
+		c.logToUIf(":send needs a user name (or \"all\") and a file path, received %v\n", args[1:])
+		return
+	}
+	if c.isMuted() {
+		return
+	}
+	// hashing large files takes a while, so it must not hold up the UI
+	go c.offerFile(args[1], strings.TrimSpace(args[2]))
+}
+
+func (c *Client) offerFile(to, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		c.logToUIf("could not send file: %v\n", err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		c.logToUIf("could not send \"%s\": not a regular file\n", path)
+		return
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		c.logToUIf("could not send file: %v\n", err)
+		return
+	}
+
+	pkt := Packet{User: c.Name, Type: MsgTypeFileOffer}
+	if to != "all" {
+		pkt.To = to
+	}
+	c.stamp(&pkt)
+	pkt.File = &File{ID: pkt.ID, Name: info.Name(), Size: info.Size(), SHA256: hex.EncodeToString(h.Sum(nil))}
+	c.files.mu.Lock()
+	if c.files.uploads == nil {
+		c.files.uploads = make(map[string]*upload)
+	}
+	c.files.uploads[pkt.ID] = &upload{path: path, file: *pkt.File}
+	c.files.mu.Unlock()
+
+	if pkt.To == "" {
+		c.broadcast(pkt, "")
+	} else {
+		peersMu.RLock()
+		legacy := false
+		for _, peer := range c.peers {
+			if peer.name == to && !hasCapability(peer.caps, filesCapability) {
+				legacy = true
+			}
+		}
+		peersMu.RUnlock()
+		if legacy {
+			c.logToUIf("\"%s\" runs an older lanchat version, without file transfers\n", to)
+			return
+		}
+		if !c.deliver(pkt) {
+			c.logToUIf("no user named \"%s\"\n", to)
+			return
+		}
+	}
+	c.logToUIf("offered \"%s\" (%s) to %s; waiting for them to accept it", info.Name(), formatSize(info.Size()), to)
+}
+
+func fileOfferInHandler(c *Client, p Packet, from peerID) {
+	if c.mutedSender(from) {
+		return
+	}
+	peersMu.RLock()
+	forwarded := c.forward(p, from)
+	peersMu.RUnlock()
+	if forwarded || p.File == nil || c.ignoring(p) {
+		return
+	}
+	c.files.mu.Lock()
+	if c.files.downloads == nil {
+		c.files.downloads = make(map[downloadKey]*download)
+	}
+	d := &download{from: p.User, file: *p.File}
+	if _, ok := c.files.downloads[d.key()]; ok {
+		// offers are only made once; this one is stale or a replay
+		c.files.mu.Unlock()
+		return
+	}
+	c.files.downloads[d.key()] = d
+	c.files.offers = append(c.files.offers, d)
+	c.files.mu.Unlock()
+	c.logToUIf("\"%s\" offers you \"%s\" (%s). Run \":accept\" to download it, or \":reject\" to refuse it", p.User, p.File.Name, formatSize(p.File.Size))
+}
+
+// takeOffer removes and returns the most recent offer of a file with the
+// given name or transfer ID, or the most recent offer if query is empty
+func (c *Client) takeOffer(query string) *download {
+	c.files.mu.Lock()
+	defer c.files.mu.Unlock()
+	for i := len(c.files.offers) - 1; i >= 0; i-- {
+		d := c.files.offers[i]
+		if query == "" || d.file.ID == query || d.file.Name == query {
+			c.files.offers = append(c.files.offers[:i], c.files.offers[i+1:]...)
+			return d
+		}
+	}
+	return nil
+}
+
+// acceptOutHandler accepts a file offered to this client, given its name,
+// or the last one offered
+func acceptOutHandler(c *Client, p ui.Packet) {
+	query := commandArg(p.Msg)
+	d := c.takeOffer(query)
+	if d == nil {
+		c.logToUIf("no file offered matching \"%s\"\n", query)
+		return
+	}
+	if err := os.MkdirAll(c.DownloadDir, 0700); err != nil {
+		c.logToUIf("could not create download directory: %v\n", err)
+		return
+	}
+	part, err := ioutil.TempFile(c.DownloadDir, "."+safeFileName(d.file.Name)+".*.part")
+	if err != nil {
+		c.logToUIf("could not download \"%s\": %v\n", d.file.Name, err)
+		return
+	}
+	c.files.mu.Lock()
+	d.accepted = true
+	d.part = part
+	d.hash = sha256.New()
+	c.files.mu.Unlock()
+	c.deliver(Packet{User: c.Name, Type: MsgTypeFileAccept, To: d.from, File: &File{ID: d.file.ID}})
+	c.logToUIf("downloading \"%s\" from \"%s\"", d.file.Name, d.from)
+}
+
+// rejectOutHandler refuses a file offered to this client, given its name,
+// or the last one offered
+func rejectOutHandler(c *Client, p ui.Packet) {
+	query := commandArg(p.Msg)
+	d := c.takeOffer(query)
+	if d == nil {
+		c.logToUIf("no file offered matching \"%s\"\n", query)
+		return
+	}
+	c.files.mu.Lock()
+	delete(c.files.downloads, d.key())
+	c.files.mu.Unlock()
+	c.deliver(Packet{User: c.Name, Type: MsgTypeFileReject, To: d.from, File: &File{ID: d.file.ID}})
+	c.logToUIf("rejected \"%s\" from \"%s\"", d.file.Name, d.from)
+}
+
+// fileAnswerInHandler handles peers accepting or rejecting a file offered
+// by this client
+func fileAnswerInHandler(c *Client, p Packet, from peerID) {
+	peersMu.RLock()
+	forwarded := c.forward(p, from)
+	peersMu.RUnlock()
+	if forwarded || p.File == nil {
+		return
+	}
+	c.files.mu.Lock()
+	up, ok := c.files.uploads[p.File.ID]
+	c.files.mu.Unlock()
+	if !ok {
+		return
+	}
+	if p.Type == MsgTypeFileReject {
+		c.logToUIf("\"%s\" rejected \"%s\"", p.User, up.file.Name)
+		return
+	}
+	go c.stream(up, p.User)
+}
+
+// route returns the connection packets for the given user go through: a
+// direct one if there is any, or else the one to the host, which forwards
+// them. Callers must hold peersMu.
+func (c *Client) route(name string) (peerID, *peer) {
+	var host peerID
+	for pid, peer := range c.peers {
+		if peer.name == name {
+			return pid, peer
+		}
+		if peer.host {
+			host = pid
+		}
+	}
+	return host, c.peers[host]
+}
+
+// stream sends a file offered by this client in chunks, to a user who
+// accepted it. Chunks must arrive in order, so they all go through the same
+// connection. They are sent without holding peersMu, so that a slow
+// recipient doesn't hold up the rest of the chat. Only the size offered is
+// sent, even if the file grew since.
+func (c *Client) stream(up *upload, to string) {
+	f, err := os.Open(up.path)
+	if err != nil {
+		c.logToUIf("could not send \"%s\" to \"%s\": %v\n", up.file.Name, to, err)
+		return
+	}
+	defer f.Close()
+	peersMu.RLock()
+	pid, peer := c.route(to)
+	peersMu.RUnlock()
+	if peer == nil {
+		c.logToUIf("could not send \"%s\": \"%s\" is gone\n", up.file.Name, to)
+		return
+	}
+	send := func(chunk *File) bool {
+		if err := peer.send(Packet{User: c.Name, Type: MsgTypeFileChunk, To: to, File: chunk}); err != nil {
+			c.logToUIf("could not send \"%s\" to \"%s\": %v\n", up.file.Name, to, err)
+			go c.cleanPeer(pid)
+			return false
+		}
+		return true
+	}
+	c.logToUIf("sending \"%s\" to \"%s\"", up.file.Name, to)
+	r := io.LimitReader(f, up.file.Size)
+	buf := make([]byte, fileChunkSize)
+	var offset int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if !send(&File{ID: up.file.ID, Offset: offset, Data: buf[:n]}) {
+				return
+			}
+			if progressed(offset, offset+int64(n), up.file.Size) {
+				c.logToUIf("sent %d%% of \"%s\" to \"%s\"", (offset+int64(n))*100/up.file.Size, up.file.Name, to)
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.logToUIf("could not send \"%s\" to \"%s\": %v\n", up.file.Name, to, err)
+			return
+		}
+	}
+	send(&File{ID: up.file.ID, Offset: offset})
+}
+
+func fileChunkInHandler(c *Client, p Packet, from peerID) {
+	peersMu.RLock()
+	forwarded := c.forward(p, from)
+	peersMu.RUnlock()
+	if forwarded || p.File == nil {
+		return
+	}
+	c.files.mu.Lock()
+	d, ok := c.files.downloads[downloadKey{p.User, p.File.ID}]
+	if !ok || !d.accepted {
+		c.files.mu.Unlock()
+		return
+	}
+	if p.File.Offset != d.received {
+		c.files.mu.Unlock()
+		c.failDownload(d, fmt.Sprintf("expected data at offset %d, got %d", d.received, p.File.Offset))
+		return
+	}
+	if len(p.File.Data) == 0 {
+		c.files.mu.Unlock()
+		c.finishDownload(d)
+		return
+	}
+	if d.received+int64(len(p.File.Data)) > d.file.Size {
+		c.files.mu.Unlock()
+		c.failDownload(d, fmt.Sprintf("received more than the %s offered", formatSize(d.file.Size)))
+		return
+	}
+	prev := d.received
+	_, err := d.part.Write(p.File.Data)
+	d.hash.Write(p.File.Data)
+	d.received += int64(len(p.File.Data))
+	received := d.received
+	c.files.mu.Unlock()
+	if err != nil {
+		c.failDownload(d, err.Error())
+		return
+	}
+	if progressed(prev, received, d.file.Size) {
+		c.logToUIf("received %d%% of \"%s\"", received*100/d.file.Size, d.file.Name)
+	}
+}
+
+// finishDownload checks a file received in full, and moves it to its final
+// place in the download directory
+func (c *Client) finishDownload(d *download) {
+	c.files.mu.Lock()
+	delete(c.files.downloads, d.key())
+	c.files.mu.Unlock()
+	d.part.Close()
+	if sum := hex.EncodeToString(d.hash.Sum(nil)); d.received != d.file.Size || sum != d.file.SHA256 {
+		os.Remove(d.part.Name())
+		c.logToUIf("download of \"%s\" failed: the file received is corrupted (SHA-256 %s, expected %s)", d.file.Name, sum, d.file.SHA256)
+		return
+	}
+	path := uniquePath(c.DownloadDir, safeFileName(d.file.Name))
+	if err := os.Rename(d.part.Name(), path); err != nil {
+		c.logToUIf("could not save \"%s\": %v\n", d.file.Name, err)
+		return
+	}
+	c.logToUIf("saved \"%s\" from \"%s\" to %s (SHA-256 verified)", d.file.Name, d.from, path)
+}
+
+// dropDownloads fails the downloads coming through a lost connection: those
+// from the peer on its other end, and those from anyone not connected
+// directly if it led to the host, which forwarded them. Callers must hold
+// peersMu.
+func (c *Client) dropDownloads(lost *peer) {
+	c.files.mu.Lock()
+	var dropped []*download
+	for key, d := range c.files.downloads {
+		if !d.accepted {
+			continue
+		}
+		_, direct := c.connectedKey(d.from)
+		if d.from == lost.name || (lost.host && !direct) {
+			// no more chunks are handled once the download is forgotten
+			delete(c.files.downloads, key)
+			dropped = append(dropped, d)
+		}
+	}
+	c.files.mu.Unlock()
+	go func() {
+		for _, d := range dropped {
+			c.failDownload(d, fmt.Sprintf("\"%s\" disconnected", d.from))
+		}
+	}()
+}
+
+func (c *Client) failDownload(d *download, reason string) {
+	c.files.mu.Lock()
+	delete(c.files.downloads, d.key())
+	c.files.mu.Unlock()
+	d.part.Close()
+	os.Remove(d.part.Name())
+	c.logToUIf("download of \"%s\" failed: %s\n", d.file.Name, reason)
+}
+
+// progressed returns whether a transfer crossed a quarter of the file size
+// when going from one offset to the other, to show its progress
+func progressed(from, to, size int64) bool {
+	if size <= 0 || to >= size {
+		return false
+	}
+	return from*4/size != to*4/size
+}
+
+// safeFileName strips any directories from the name of a file offered by a
+// peer, so that it is saved in the download directory only
+func safeFileName(name string) string {
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." {
+		return "download"
+	}
+	return name
+}
+
+// uniquePath returns a path for a new file in dir, adding a number to its
+// name if it is already taken
+func uniquePath(dir, name string) string {
+	path := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// commandArg returns everything following the command name in msg
+func commandArg(msg string) string {
+	if args := strings.SplitN(msg, " ", 2); len(args) == 2 {
+		return strings.TrimSpace(args[1])
+	}
+	return ""
+}
@@ -0,0 +1,267 @@
+package lan
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+// newTransferClients returns a client offering a file to another, each
+// connected to the other as peer "0"
+func newTransferClients(t *testing.T) (*Client, *Client, []byte) {
+	dir := tempDir(t)
+	data := make([]byte, 3*fileChunkSize+100)
+	rand.Read(data)
+	src := filepath.Join(dir, "server.log")
+	if err := ioutil.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sender := newTestClient(false, 1, &NullScanner{})
+	sender.peers["0"].caps = []string{filesCapability}
+	receiver := newTestClient(false, 1, &NullScanner{})
+	receiver.Name = "peer_0"
+	receiver.peers["0"].name = "testClient"
+	receiver.DownloadDir = filepath.Join(dir, "downloads")
+
+	sender.offerFile("peer_0", src)
+	pkts, err := readFromPeer(&sender, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 1 || pkts[0].Type != MsgTypeFileOffer || pkts[0].File.Size != int64(len(data)) {
+		t.Fatalf("expected file offer, got %+v", pkts)
+	}
+	handleInbound(&receiver, pkts[0], "0")
+	// packets are read with a new decoder each time, so the encoder must
+	// send type information again
+	peer := sender.peers["0"]
+	peer.enc = gob.NewEncoder(peer.conn.(io.Writer))
+	return &sender, &receiver, data
+}
+
+// accept accepts the file offered to receiver, and streams it from sender,
+// returning the chunks sent
+func accept(t *testing.T, sender, receiver *Client) []Packet {
+	handleOutbound(receiver, ui.Packet{Msg: ":accept server.log"})
+	pkts, err := readFromPeer(receiver, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 1 || pkts[0].Type != MsgTypeFileAccept {
+		t.Fatalf("expected file to be accepted, got %+v", pkts)
+	}
+	up := sender.files.uploads[pkts[0].File.ID]
+	if up == nil {
+		t.Fatalf("no file offered with ID %s", pkts[0].File.ID)
+	}
+	sender.stream(up, "peer_0")
+	chunks, err := readFromPeer(sender, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+func TestFileTransfer(t *testing.T) {
+	sender, receiver, data := newTransferClients(t)
+	chunks := accept(t, sender, receiver)
+	if len(chunks) != 5 {
+		t.Errorf("expected 4 chunks and an empty one, got %d", len(chunks))
+	}
+	for _, pkt := range chunks {
+		handleInbound(receiver, pkt, "0")
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(receiver.DownloadDir, "server.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("expected file received to match the one sent")
+	}
+	uiPackets, err := readUI(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := uiPackets[len(uiPackets)-1].Msg; !strings.HasPrefix(last, "saved \"server.log\"") {
+		t.Errorf("expected file to be saved, got %q", last)
+	}
+	if len(receiver.files.downloads) != 0 {
+		t.Errorf("expected download to be done, got %+v", receiver.files.downloads)
+	}
+}
+
+func TestFileTransferCorrupted(t *testing.T) {
+	sender, receiver, _ := newTransferClients(t)
+	chunks := accept(t, sender, receiver)
+	chunks[1].File.Data[0]++
+	for _, pkt := range chunks {
+		handleInbound(receiver, pkt, "0")
+	}
+
+	files, err := ioutil.ReadDir(receiver.DownloadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected corrupted file to be removed, got %v", files)
+	}
+	uiPackets, err := readUI(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := uiPackets[len(uiPackets)-1].Msg; !strings.Contains(last, "corrupted") {
+		t.Errorf("expected download to fail, got %q", last)
+	}
+}
+
+func TestFileReject(t *testing.T) {
+	sender, receiver, _ := newTransferClients(t)
+	handleOutbound(receiver, ui.Packet{Msg: ":reject"})
+	pkts, err := readFromPeer(receiver, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 1 || pkts[0].Type != MsgTypeFileReject {
+		t.Fatalf("expected file to be rejected, got %+v", pkts)
+	}
+	handleInbound(sender, pkts[0], "0")
+	// nothing is left to accept
+	handleOutbound(receiver, ui.Packet{Msg: ":accept"})
+
+	uiPackets, err := readUI(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := uiPackets[len(uiPackets)-1].Msg; last != "\"peer_0\" rejected \"server.log\"" {
+		t.Errorf("expected rejection to be shown, got %q", last)
+	}
+	uiPackets, err = readUI(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := uiPackets[len(uiPackets)-1].Msg; last != "no file offered matching \"\"\n" {
+		t.Errorf("expected no offer left, got %q", last)
+	}
+	if _, err := os.Stat(receiver.DownloadDir); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be downloaded")
+	}
+}
+
+func TestFileOfferRepeated(t *testing.T) {
+	_, receiver, _ := newTransferClients(t)
+	offer := receiver.files.offers[0]
+	pkt := Packet{User: "testClient", Type: MsgTypeFileOffer, ID: "testClientID-99", File: &File{ID: offer.file.ID, Name: "server.log", Size: 1}}
+	handleInbound(receiver, pkt, "0")
+	// another user picking the same transfer ID makes a separate offer
+	pkt.User = "peer_1"
+	pkt.ID = "peer_1ID-1"
+	pkt.File.Name = "other.log"
+	handleInbound(receiver, pkt, "0")
+	if len(receiver.files.offers) != 2 || len(receiver.files.downloads) != 2 {
+		t.Fatalf("expected the repeated offer to be dropped, got %+v", receiver.files.offers)
+	}
+	if d := receiver.files.offers[0]; d.file.Size == 1 {
+		t.Errorf("expected the first offer to be kept, got %+v", d.file)
+	}
+
+	handleOutbound(receiver, ui.Packet{Msg: ":reject server.log"})
+	handleOutbound(receiver, ui.Packet{Msg: ":accept server.log"})
+	uiPackets, err := readUI(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := uiPackets[len(uiPackets)-1].Msg; last != "no file offered matching \"server.log\"\n" {
+		t.Errorf("expected no offer left, got %q", last)
+	}
+	if d := receiver.files.offers[0]; len(receiver.files.offers) != 1 || d.from != "peer_1" {
+		t.Errorf("expected the offer of peer_1 to be left, got %+v", receiver.files.offers)
+	}
+}
+
+func TestFileHelpers(t *testing.T) {
+	names := map[string]string{
+		"server.log":       "server.log",
+		"../../etc/passwd": "passwd",
+		"/":                "download",
+		"..":               "download",
+	}
+	for in, out := range names {
+		if got := safeFileName(in); got != out {
+			t.Errorf("safeFileName(%q): expected %q, got %q", in, out, got)
+		}
+	}
+
+	dir := tempDir(t)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), nil, 0600)
+	if got := uniquePath(dir, "a.txt"); got != filepath.Join(dir, "a (1).txt") {
+		t.Errorf("expected taken name to be numbered, got %s", got)
+	}
+
+	sizes := map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KB", 5 << 20: "5.0 MB"}
+	for in, out := range sizes {
+		if got := formatSize(in); got != out {
+			t.Errorf("formatSize(%d): expected %q, got %q", in, out, got)
+		}
+	}
+
+	if !progressed(0, 30, 100) || progressed(30, 40, 100) || progressed(90, 100, 100) {
+		t.Errorf("expected progress to be shown at every quarter, except the end")
+	}
+}
+
+func TestFileTransferTooLong(t *testing.T) {
+	sender, receiver, _ := newTransferClients(t)
+	chunks := accept(t, sender, receiver)
+	last := chunks[len(chunks)-2].File
+	last.Data = append(last.Data, 0)
+	for _, pkt := range chunks {
+		handleInbound(receiver, pkt, "0")
+	}
+
+	files, err := ioutil.ReadDir(receiver.DownloadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected partial file to be removed, got %v", files)
+	}
+	uiPackets, err := readUI(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := uiPackets[len(uiPackets)-1].Msg; !strings.Contains(last, "received more than") {
+		t.Errorf("expected download to fail, got %q", last)
+	}
+}
+
+func TestFileSenderGone(t *testing.T) {
+	sender, receiver, _ := newTransferClients(t)
+	chunks := accept(t, sender, receiver)
+	handleInbound(receiver, chunks[0], "0")
+	// losing the last peer makes the client look for a host again
+	receiver.restart = make(chan int, 1)
+	receiver.cleanPeer("0")
+	// chunks still in flight are ignored
+	handleInbound(receiver, chunks[1], "0")
+
+	uiPackets := receiveUI(t, receiver, 4)
+	if last := uiPackets[3].Msg; !strings.HasPrefix(last, "download of \"server.log\" failed: \"testClient\" disconnected") {
+		t.Errorf("expected download to fail, got %q", last)
+	}
+	files, err := ioutil.ReadDir(receiver.DownloadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 || len(receiver.files.downloads) != 0 {
+		t.Errorf("expected partial file to be removed, got %v", files)
+	}
+}
@@ -0,0 +1,436 @@
+package lan
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/MarcPer/lanchat/logger"
+)
+
+// ProtocolVersion is the version of the messages exchanged between peers.
+// Peers running a different version are rejected during the handshake, and
+// ignored during discovery.
+const ProtocolVersion = 5
+
+// capabilities lists optional features supported by this client, announced
+// to peers during the handshake
+var capabilities = []string{"mesh", "members", "rooms", "private", "history", "receipts", pongCapability, filesCapability, "presence", namesCapability, "typing"}
+
+// filesCapability is announced by peers supporting file transfers
+const filesCapability = "files"
+
+const handshakeTimeout = 5 * time.Second
+
+// hasCapability returns whether a peer announced the given capability
+func hasCapability(caps []string, name string) bool {
+	for _, c := range caps {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Hello introduces a client to a peer. It is the first packet sent over a
+// new connection, in a MsgTypeHello packet. Both sides then prove they know
+// the room key (see Auth), after which the peer answers with its own Hello
+// in a MsgTypeWelcome packet. At any step, a MsgTypeReject packet may be
+// sent instead, explaining why the connection was refused.
+type Hello struct {
+	Version      int
+	Capabilities []string
+	Name         string
+	Network      string
+	ID           string // node ID
+	Addr         string // address where the client accepts connections; see PeerInfo
+	Rooms        []string
+	Presence     Presence
+	Client       string // lanchat version
+	Key          []byte // public identity key, if the client has one
+	KeyProof     []byte // signature of the session with Key, proving the client holds it; see sessionBinding
+}
+
+// Auth carries the challenge-response proving that both sides of a
+// connection know the room key, without sending it. The dialing side sends a
+// random nonce along with its Hello; the other side answers with a
+// MsgTypeChallenge packet, holding the proof for that nonce and a nonce of
+// its own, which is answered by the dialing side with a MsgTypeAuth packet.
+type Auth struct {
+	Nonce []byte
+	Proof []byte
+}
+
+// labels distinguishing the proofs computed by each side of a connection,
+// so that one can't be replayed as the other
+const (
+	proofAccept  = "lanchat-accept"
+	proofConnect = "lanchat-connect"
+)
+
+// roomProof returns the proof of knowledge of key for the given challenge,
+// bound to the given session (see sessionBinding)
+func roomProof(key, label string, challenge, session []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(label))
+	mac.Write(challenge)
+	mac.Write(session)
+	return mac.Sum(nil)
+}
+
+// sessionBinding returns keying material unique to the TLS session of conn,
+// or nil if it isn't encrypted. Room key proofs are bound to it: since peers
+// don't verify each other's certificates, someone in the middle could
+// otherwise relay the proofs between two sessions of their own, and read
+// everything sent over them.
+func sessionBinding(conn net.Conn) ([]byte, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tc.ConnectionState()
+	return state.ExportKeyingMaterial("lanchat room proof", nil, sha256.Size)
+}
+
+// errOtherChat is returned when dialing a peer of another chat: one in
+// another network, or not knowing the room key
+type errOtherChat string
+
+func (e errOtherChat) Error() string {
+	return string(e)
+}
+
+func newNonce() []byte {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logger.Errorf("newNonce: %v\n", err)
+	}
+	return b
+}
+
+// hello introduces this client over the given session (see sessionBinding)
+func (c *Client) hello(session []byte) *Hello {
+	var proof []byte
+	if c.Identity != nil {
+		proof = ed25519.Sign(c.Identity.key, keyProofData(session))
+	}
+	return &Hello{
+		Version:      ProtocolVersion,
+		Capabilities: capabilities,
+		Name:         c.Name,
+		Network:      c.Network,
+		ID:           c.id,
+		Addr:         fmt.Sprintf(":%d", c.port),
+		Rooms:        roomList(c.rooms),
+		Presence:     c.presence,
+		Client:       Version,
+		Key:          c.publicKey(),
+		KeyProof:     proof,
+	}
+}
+
+// keyProofData returns what clients sign to prove they hold their identity
+// key. Since it is bound to the session, the proof can't be replayed by
+// someone presenting the key of another user as their own.
+func keyProofData(session []byte) []byte {
+	return append([]byte("lanchat identity proof"), session...)
+}
+
+// checkKeyProof returns whether a peer introducing itself with h over the
+// given session holds the identity key it presents, if any
+func checkKeyProof(h *Hello, session []byte) bool {
+	if len(h.Key) == 0 {
+		return true
+	}
+	return len(h.Key) == ed25519.PublicKeySize && ed25519.Verify(ed25519.PublicKey(h.Key), keyProofData(session), h.KeyProof)
+}
+
+// checkHello returns the reason for rejecting a peer introducing itself
+// with h, or an empty string if it is compatible
+func checkHello(h *Hello, network string) string {
+	if h == nil {
+		return "missing handshake"
+	}
+	if h.Version != ProtocolVersion {
+		return fmt.Sprintf("incompatible lanchat versions: peer uses protocol version %d, but version %d is required", h.Version, ProtocolVersion)
+	}
+	if h.Network != network {
+		return fmt.Sprintf("peer belongs to network %q, not %q", h.Network, network)
+	}
+	if h.Name == "" || h.ID == "" {
+		return "missing user name or ID"
+	}
+	return ""
+}
+
+// handshake introduces this client over a connection it dialed. It returns
+// the peer on the other side, along with the members it knows about.
+func (c *Client) handshake(conn net.Conn) (*peer, []PeerInfo, error) {
+	if c.TLS != nil {
+		conn = tls.Client(conn, c.TLS)
+	}
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	session, err := sessionBinding(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	peersMu.RLock()
+	hello := c.hello(session)
+	peersMu.RUnlock()
+	nonce := newNonce()
+	if err := enc.Encode(Packet{Type: MsgTypeHello, Hello: hello, Auth: &Auth{Nonce: nonce}}); err != nil {
+		return nil, nil, err
+	}
+	var pkt Packet
+	if err := dec.Decode(&pkt); err != nil {
+		return nil, nil, fmt.Errorf("no answer to handshake; the peer may run an older lanchat version (%v)", err)
+	}
+	switch pkt.Type {
+	case MsgTypeChallenge:
+	case MsgTypeReject:
+		if pkt.Hello != nil && pkt.Hello.Network != c.Network {
+			return nil, nil, errOtherChat("connection rejected: " + pkt.Msg)
+		}
+		return nil, nil, fmt.Errorf("connection rejected: %s", pkt.Msg)
+	default:
+		return nil, nil, fmt.Errorf("unexpected answer to handshake; the peer may run an older lanchat version")
+	}
+	if pkt.Auth == nil || !hmac.Equal(pkt.Auth.Proof, roomProof(c.RoomKey, proofAccept, nonce, session)) {
+		return nil, nil, errOtherChat("peer does not know the room key")
+	}
+	if err := enc.Encode(Packet{Type: MsgTypeAuth, Auth: &Auth{Proof: roomProof(c.RoomKey, proofConnect, pkt.Auth.Nonce, session)}}); err != nil {
+		return nil, nil, err
+	}
+	pkt = Packet{}
+	if err := dec.Decode(&pkt); err != nil {
+		return nil, nil, fmt.Errorf("no answer to handshake (%v)", err)
+	}
+	switch pkt.Type {
+	case MsgTypeWelcome:
+	case MsgTypeReject:
+		return nil, nil, fmt.Errorf("connection rejected: %s", pkt.Msg)
+	default:
+		return nil, nil, fmt.Errorf("unexpected answer to handshake; the peer may run an older lanchat version")
+	}
+	if reason := checkHello(pkt.Hello, c.Network); reason != "" {
+		return nil, nil, fmt.Errorf("rejected peer: %s", reason)
+	}
+	if !checkKeyProof(pkt.Hello, session) {
+		return nil, nil, fmt.Errorf("rejected peer: it doesn't hold the identity key it presents")
+	}
+	p := &peer{id: pkt.Hello.ID, name: pkt.Hello.Name, caps: pkt.Hello.Capabilities, rooms: roomSet(pkt.Hello.Rooms), presence: pkt.Hello.Presence, client: pkt.Hello.Client, key: pkt.Hello.Key, since: time.Now(), lastSeen: time.Now(), conn: conn, enc: enc, dec: dec}
+	p.fingerprint = peerFingerprint(conn)
+	if err := c.verifyFingerprint(p.name, p.key, p.fingerprint); err != nil {
+		return nil, nil, fmt.Errorf("rejected peer: %v", err)
+	}
+	c.verifyKey(p.name, p.key)
+	if pkt.Name != "" {
+		c.logToUIf("the name \"%s\" is taken; you are \"%s\"", hello.Name, pkt.Name)
+		c.rename(pkt.Name)
+	}
+	return p, pkt.Peers, nil
+}
+
+// accept waits for a peer which connected to this client to introduce
+// itself, and starts handling its packets if it is compatible
+func (c *Client) accept(conn net.Conn) {
+	var pid peerID = peerID(conn.RemoteAddr().String())
+	if c.TLS != nil {
+		conn = tls.Server(conn, c.TLS)
+	}
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	var pkt Packet
+	if err := dec.Decode(&pkt); err != nil {
+		logger.Debugf("accept: %v\n", err)
+		conn.Close()
+		return
+	}
+	if pkt.Type != MsgTypeHello {
+		// clients predating the handshake only understand admin messages
+		reason := "incompatible lanchat versions: please upgrade"
+		enc.Encode(Packet{Type: MsgTypeAdmin, Msg: reason})
+		c.logToUIf("rejected connection from %s: %s", pid, reason)
+		conn.Close()
+		return
+	}
+
+	reject := func(reason string) {
+		enc.Encode(Packet{Type: MsgTypeReject, Msg: reason})
+		c.logToUIf("rejected connection from %s: %s", pid, reason)
+		conn.Close()
+	}
+	h := pkt.Hello
+	if reason := checkHello(h, c.Network); reason != "" {
+		if h != nil && h.Network != c.Network {
+			// the network is no secret, as hosts announce it; telling it
+			// keeps peers of other networks from taking this client for
+			// their host over and over again
+			enc.Encode(Packet{Type: MsgTypeReject, Msg: reason, Hello: &Hello{Network: c.Network}})
+			c.logToUIf("rejected connection from %s: %s", pid, reason)
+			conn.Close()
+			return
+		}
+		reject(reason)
+		return
+	}
+	if c.Bans != nil && c.Bans.Banned(h.Name, peerIP(pid)) {
+		reject("you are banned from this chat")
+		return
+	}
+	if pkt.Auth == nil {
+		reject("missing room key challenge")
+		return
+	}
+	session, err := sessionBinding(conn)
+	if err != nil {
+		logger.Debugf("accept: %v\n", err)
+		conn.Close()
+		return
+	}
+	nonce := newNonce()
+	if err := enc.Encode(Packet{Type: MsgTypeChallenge, Auth: &Auth{Nonce: nonce, Proof: roomProof(c.RoomKey, proofAccept, pkt.Auth.Nonce, session)}}); err != nil {
+		logger.Debugf("accept: %v\n", err)
+		conn.Close()
+		return
+	}
+	pkt = Packet{}
+	if err := dec.Decode(&pkt); err != nil {
+		// the peer hangs up if this client doesn't know the room key
+		logger.Debugf("accept: %v\n", err)
+		conn.Close()
+		return
+	}
+	if pkt.Type != MsgTypeAuth || pkt.Auth == nil || !hmac.Equal(pkt.Auth.Proof, roomProof(c.RoomKey, proofConnect, nonce, session)) {
+		reject("wrong room key")
+		return
+	}
+	if !checkKeyProof(h, session) {
+		reject("you don't hold the identity key you present")
+		return
+	}
+	fingerprint := peerFingerprint(conn)
+	if err := c.verifyFingerprint(h.Name, h.Key, fingerprint); err != nil {
+		reject(err.Error())
+		return
+	}
+
+	if stale := c.staleLink(h); stale != "" {
+		// the peer lost its end of the link before this end noticed, and
+		// reconnects; the new link replaces the old one
+		c.cleanPeer(stale)
+	}
+	peersMu.Lock()
+	if h.ID == c.id || c.connectedTo(h.ID) {
+		peersMu.Unlock()
+		reject("already connected")
+		return
+	}
+	if !c.host && !c.vouched(h) {
+		peersMu.Unlock()
+		reject("you are not listed as a member by the host")
+		return
+	}
+	var members []PeerInfo
+	name, assigned := h.Name, ""
+	if c.host {
+		members = c.memberList("")
+		// the host makes sure names are unique, so that everyone can tell
+		// who said what
+		name = c.uniqueName(h.Name, "")
+		if name != h.Name {
+			if !hasCapability(h.Capabilities, namesCapability) {
+				peersMu.Unlock()
+				reject(fmt.Sprintf("the name \"%s\" is taken", h.Name))
+				return
+			}
+			assigned = name
+		}
+	}
+	if err := enc.Encode(Packet{Type: MsgTypeWelcome, Hello: c.hello(session), Peers: members, Name: assigned}); err != nil {
+		peersMu.Unlock()
+		logger.Debugf("accept: %v\n", err)
+		conn.Close()
+		return
+	}
+	p := &peer{id: h.ID, name: name, addr: resolveAddr(h.Addr, pid), caps: h.Capabilities, rooms: roomSet(h.Rooms), presence: h.Presence, client: h.Client, key: h.Key, since: time.Now(), lastSeen: time.Now(), conn: conn, enc: enc, dec: dec}
+	p.fingerprint = fingerprint
+	c.peers[pid] = p
+	c.sendMembers()
+	if c.host {
+		c.replayHistory(pid)
+	}
+	c.peersChanged()
+	peersMu.Unlock()
+	conn.SetDeadline(time.Time{})
+
+	c.verifyKey(p.name, p.key)
+	c.logToUIf("user \"%s\" connected", name)
+	go c.handleConn(pid)
+}
+
+// vouched returns whether the host listed the peer introducing itself with
+// h as a member, with the identity key it proved to hold. Only the host
+// checks bans, so members accept no one else. Callers must hold peersMu.
+func (c *Client) vouched(h *Hello) bool {
+	for _, m := range c.members {
+		if m.ID == h.ID && m.Key == keyFingerprint(h.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// staleLink returns the ID of the host's connection to the peer introducing
+// itself with h, if it has one already. Peers only dial the host again after
+// losing their link to it, so the old one is dead, even if the host didn't
+// notice yet. Only a peer proving the same identity key can take the link
+// over. Members dial each other at the same time when joining, so they keep
+// refusing second links instead.
+func (c *Client) staleLink(h *Hello) peerID {
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	if !c.host || len(h.Key) == 0 {
+		return ""
+	}
+	for pid, p := range c.peers {
+		if p.id == h.ID && bytes.Equal(p.key, h.Key) {
+			return pid
+		}
+	}
+	return ""
+}
+
+// verifyFingerprint returns an error if a peer, known by the given identity
+// key, presents a certificate other than the one seen the first time it
+// connected. Names can be taken by anyone, so peers without an identity key
+// aren't pinned.
+func (c *Client) verifyFingerprint(name string, key []byte, fp string) error {
+	if c.KnownPeers == nil || fp == "" || len(key) == 0 {
+		return nil
+	}
+	pinned, known := c.KnownPeers.Pin(keyFingerprint(key), fp)
+	if !known {
+		c.logToUIf("first connection from \"%s\", with fingerprint %s", name, fp)
+	} else if pinned != fp {
+		c.logToUIf("WARNING: fingerprint of \"%s\" changed from %s to %s. Someone may be impersonating them! If they changed their certificate, remove their identity key from known_peers in the config directory.", name, pinned, fp)
+		return fmt.Errorf("certificate fingerprint %s does not match %s, seen before with the same identity key", fp, pinned)
+	}
+	return nil
+}
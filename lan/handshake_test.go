@@ -0,0 +1,239 @@
+package lan
+
+import (
+	"encoding/gob"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckHello(t *testing.T) {
+	valid := Hello{Version: ProtocolVersion, Name: "jon", Network: "office", ID: "abc"}
+	tests := []struct {
+		name   string
+		hello  func(h *Hello)
+		reason string
+	}{
+		{"compatible", func(h *Hello) {}, ""},
+		{"older version", func(h *Hello) { h.Version = ProtocolVersion - 1 }, "incompatible lanchat versions"},
+		{"other network", func(h *Hello) { h.Network = "home" }, "peer belongs to network \"home\""},
+		{"no name", func(h *Hello) { h.Name = "" }, "missing user name or ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := valid
+			tt.hello(&h)
+			reason := checkHello(&h, "office")
+			if (reason == "") != (tt.reason == "") || !strings.HasPrefix(reason, tt.reason) {
+				t.Errorf("expected reason starting with %q, got %q", tt.reason, reason)
+			}
+		})
+	}
+}
+
+// listen accepts a single connection on c, returning the address to dial
+func listen(t *testing.T, c *Client) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c.accept(conn)
+	}()
+	return ln.Addr().String()
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		guest   func(c *Client)
+		err     string
+		members []PeerInfo
+	}{
+		{
+			"accepted",
+			func(c *Client) {},
+			"",
+			[]PeerInfo{{ID: "testClientID", Name: "testClient", Addr: ":0", Role: RoleOwner}, {ID: "peer0ID", Name: "peer_0", Addr: "10.0.0.2:4000"}},
+		},
+		{"other network", func(c *Client) { c.Network = "home" }, "connection rejected: peer belongs to network \"home\", not \"office\"", nil},
+		{"same node", func(c *Client) { c.id = "testClientID" }, "connection rejected: already connected", nil},
+		{"wrong room key", func(c *Client) { c.RoomKey = "guess" }, "peer does not know the room key", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := newTestClient(true, 1, &NullScanner{})
+			host.Network = "office"
+			host.RoomKey = "secret"
+			host.peers["0"].id = "peer0ID"
+			host.peers["0"].addr = "10.0.0.2:4000"
+			host.presence = Presence{Status: PresenceBusy}
+			guest := newTestClient(false, 0, &NullScanner{})
+			guest.Name = "guest"
+			guest.id = "guestID"
+			guest.Network = "office"
+			guest.RoomKey = "secret"
+			tt.guest(&guest)
+
+			conn, err := net.Dial("tcp", listen(t, &host))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			p, members, err := guest.handshake(conn)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				// peers of other chats are not mistaken for a host
+				if _, other := err.(errOtherChat); other != (tt.name != "same node") {
+					t.Errorf("expected other chat=%v, got %v", !other, other)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.id != "testClientID" || p.name != "testClient" || p.presence.Status != PresenceBusy {
+				t.Errorf("expected busy peer testClient, got %+v", p)
+			}
+			if err = comparePeerInfo(tt.members, members); err != nil {
+				t.Error(err)
+			}
+			waitFor(t, func() bool {
+				peersMu.RLock()
+				defer peersMu.RUnlock()
+				return len(host.peers) == 2
+			})
+		})
+	}
+}
+
+func TestHandshakeWithLegacyClient(t *testing.T) {
+	host := newTestClient(true, 0, &NullScanner{})
+	conn, err := net.Dial("tcp", listen(t, &host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := gob.NewEncoder(conn).Encode(Packet{Type: MsgTypeCmd, Msg: ":id old"}); err != nil {
+		t.Fatal(err)
+	}
+	var pkt Packet
+	if err := gob.NewDecoder(conn).Decode(&pkt); err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Type != MsgTypeAdmin || !strings.Contains(pkt.Msg, "please upgrade") {
+		t.Errorf("expected admin message asking to upgrade, got %+v", pkt)
+	}
+}
+
+func TestHandshakeWithoutRoomKey(t *testing.T) {
+	host := newTestClient(true, 0, &NullScanner{})
+	host.RoomKey = "secret"
+	conn, err := net.Dial("tcp", listen(t, &host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	hello := &Hello{Version: ProtocolVersion, Name: "intruder", ID: "intruderID"}
+	if err := enc.Encode(Packet{Type: MsgTypeHello, Hello: hello, Auth: &Auth{Nonce: newNonce()}}); err != nil {
+		t.Fatal(err)
+	}
+	var challenge Packet
+	if err := dec.Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(Packet{Type: MsgTypeAuth, Auth: &Auth{Proof: roomProof("guess", proofConnect, challenge.Auth.Nonce, nil)}}); err != nil {
+		t.Fatal(err)
+	}
+	var pkt Packet
+	if err := dec.Decode(&pkt); err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Type != MsgTypeReject || pkt.Msg != "wrong room key" {
+		t.Errorf("expected rejection, got %+v", pkt)
+	}
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	if len(host.peers) != 0 {
+		t.Errorf("expected peer to be dropped, got %d peers", len(host.peers))
+	}
+}
+
+func TestHandshakeWithStolenKey(t *testing.T) {
+	alice, err := LoadIdentity(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := newTestClient(true, 0, &NullScanner{})
+	host.RoomKey = "secret"
+	conn, err := net.Dial("tcp", listen(t, &host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	// the key of alice is public, but only she can sign with it
+	hello := &Hello{Version: ProtocolVersion, Name: "alice", ID: "malloryID", Key: alice.PublicKey(), KeyProof: []byte("forged")}
+	if err := enc.Encode(Packet{Type: MsgTypeHello, Hello: hello, Auth: &Auth{Nonce: newNonce()}}); err != nil {
+		t.Fatal(err)
+	}
+	var challenge Packet
+	if err := dec.Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(Packet{Type: MsgTypeAuth, Auth: &Auth{Proof: roomProof("secret", proofConnect, challenge.Auth.Nonce, nil)}}); err != nil {
+		t.Fatal(err)
+	}
+	var pkt Packet
+	if err := dec.Decode(&pkt); err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Type != MsgTypeReject || pkt.Msg != "you don't hold the identity key you present" {
+		t.Errorf("expected rejection, got %+v", pkt)
+	}
+}
+
+func TestHandshakeWithMember(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		err  string
+	}{
+		{"listed by the host", "bobID", ""},
+		{"not listed", "malloryID", "connection rejected: you are not listed as a member by the host"},
+		{"using the ID of another member", "aliceID", "connection rejected: you are not listed as a member by the host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			member := newTestClient(false, 0, &NullScanner{})
+			member.members = []PeerInfo{{ID: "hostID", Name: "host"}, {ID: "aliceID", Name: "alice", Key: keyFingerprint([]byte("alice"))}, {ID: "bobID", Name: "bob"}}
+			// losing its only peer makes the member look for a host again
+			member.restart = make(chan int, 1)
+			guest := newTestClient(false, 0, &NullScanner{})
+			guest.Name = "guest"
+			guest.id = tt.id
+
+			conn, err := net.Dial("tcp", listen(t, &member))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_, _, err = guest.handshake(conn)
+			if tt.err == "" && err != nil {
+				t.Errorf("expected member to be accepted, got %v", err)
+			} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Errorf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
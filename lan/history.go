@@ -0,0 +1,69 @@
+package lan
+
+import "sync"
+
+// DefaultHistorySize is the number of chat messages kept for peers joining
+// later, unless configured otherwise
+const DefaultHistorySize = 100
+
+// history keeps the most recent chat messages in a ring buffer, so that
+// the host can replay them to peers which join later. Every peer keeps one,
+// since any of them may become the host.
+type history struct {
+	mu   sync.Mutex
+	pkts []Packet
+	next int
+	full bool
+}
+
+func newHistory(size int) *history {
+	if size <= 0 {
+		return nil
+	}
+	return &history{pkts: make([]Packet, size)}
+}
+
+// add records a chat message. It is a no-op on a nil history, which
+// disables it.
+func (h *history) add(pkt Packet) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pkt.Type = MsgTypeChat
+	h.pkts[h.next] = pkt
+	h.next = (h.next + 1) % len(h.pkts)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the recorded messages, oldest first
+func (h *history) list() []Packet {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full {
+		return append([]Packet(nil), h.pkts[:h.next]...)
+	}
+	return append(append([]Packet(nil), h.pkts[h.next:]...), h.pkts[:h.next]...)
+}
+
+// replayHistory sends the recorded messages of the rooms a newly connected
+// peer is in. Callers must hold peersMu.
+func (c *Client) replayHistory(pid peerID) {
+	peer, ok := c.peers[pid]
+	if !ok {
+		return
+	}
+	for _, pkt := range c.history.list() {
+		if !inRoom(peer.rooms, pkt.Room) {
+			continue
+		}
+		pkt.Type = MsgTypeHistory
+		c.transmit(pkt, pid)
+	}
+}
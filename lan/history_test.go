@@ -0,0 +1,130 @@
+package lan
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/MarcPer/lanchat/store"
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestHistory(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		added int
+		first string
+		count int
+	}{
+		{"disabled", 0, 3, "", 0},
+		{"not full", 5, 3, "0", 3},
+		{"full", 3, 3, "0", 3},
+		{"wrapped around", 3, 5, "2", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHistory(tt.size)
+			for i := 0; i < tt.added; i++ {
+				h.add(Packet{Msg: strconv.Itoa(i), Type: MsgTypeHistory})
+			}
+			pkts := h.list()
+			if len(pkts) != tt.count {
+				t.Fatalf("expected %d packets, got %d", tt.count, len(pkts))
+			}
+			if tt.count > 0 && pkts[0].Msg != tt.first {
+				t.Errorf("expected oldest packet to be %s, got %s", tt.first, pkts[0].Msg)
+			}
+			for _, p := range pkts {
+				if p.Type != MsgTypeChat {
+					t.Errorf("expected packets to be stored as chat messages, got type %d", p.Type)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayHistory(t *testing.T) {
+	c := newTestClient(true, 1, &NullScanner{})
+	c.history = newHistory(10)
+	handleInbound(&c, Packet{User: "peer_0", Msg: "hi", ID: "a-1", Room: DefaultRoom}, "0")
+	handleOutbound(&c, ui.Packet{Msg: "hello"})
+	c.history.add(Packet{User: "peer_0", Msg: "secret plans", ID: "a-2", Room: "backend"})
+
+	c.replayHistory("0")
+
+	pkts, err := readFromPeer(&c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range pkts {
+		if pkts[i].ID == "testClientID-1" && (pkts[i].Clock != 1 || pkts[i].Time.IsZero()) {
+			t.Errorf("expected sent message to be stamped, got clock %d and time %v", pkts[i].Clock, pkts[i].Time)
+		}
+		pkts[i].Clock, pkts[i].Time = 0, time.Time{}
+	}
+	// the first packets acknowledge the message from peer_0 and send it
+	// the message typed while it was connected; the message in #backend
+	// isn't replayed, as peer_0 isn't in that room
+	expected := []Packet{
+		{User: "testClient", Type: MsgTypeAck, To: "peer_0", Ref: "a-1"},
+		{User: "testClient", Msg: "hello", Type: MsgTypeChat, ID: "testClientID-1", Room: DefaultRoom},
+		{User: "peer_0", Msg: "hi", Type: MsgTypeHistory, ID: "a-1", Room: DefaultRoom},
+		{User: "testClient", Msg: "hello", Type: MsgTypeHistory, ID: "testClientID-1", Room: DefaultRoom},
+	}
+	if err = compareNetPackets(expected, pkts); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHistoryInbound(t *testing.T) {
+	tests := []inboundTest{
+		{
+			"message sent before joining",
+			"0",
+			Packet{User: "peer_0", Msg: "earlier", Type: MsgTypeHistory, ID: "a-1"},
+			[]ui.Packet{{User: "peer_0", Msg: "earlier", Type: ui.PacketTypeHistory}},
+			[][]Packet{{}, {}},
+		},
+	}
+	runInboundTests(t, false, tests)
+}
+
+func TestReplayLog(t *testing.T) {
+	s, err := store.Open(tempDir(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c := newTestClient(false, 1, &NullScanner{})
+	c.history = newHistory(10)
+	c.Store = s
+	c.LogReplay = 10
+	handleOutbound(&c, ui.Packet{Msg: "before restart"})
+
+	restarted := newTestClient(false, 1, &NullScanner{})
+	restarted.history = newHistory(10)
+	restarted.Store = s
+	restarted.LogReplay = 10
+	restarted.replayLog(DefaultRoom)
+	// the host replaying the same message must not show it again
+	handleInbound(&restarted, Packet{User: "testClient", Msg: "before restart", Type: MsgTypeHistory, ID: "testClientID-1", Room: DefaultRoom}, "0")
+
+	uiPackets, err := readUI(&restarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range uiPackets {
+		if uiPackets[i].Time.IsZero() {
+			t.Errorf("expected saved message to keep the time it was sent")
+		}
+		uiPackets[i].Time = time.Time{}
+	}
+	expected := []ui.Packet{{User: "testClient", Msg: "before restart", Room: DefaultRoom, Type: ui.PacketTypeHistory}}
+	if err = compareUIPackets(expected, uiPackets); err != nil {
+		t.Error(err)
+	}
+	if len(restarted.history.list()) != 1 {
+		t.Errorf("expected saved message to be added to history")
+	}
+}
@@ -0,0 +1,218 @@
+package lan
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+// Identity is the keypair identifying a user, whatever name they use. It is
+// generated on first use and kept in the config directory, so it stays the
+// same across sessions. Chat messages are signed with it, for peers to tell
+// whether they were really sent by whom they claim.
+type Identity struct {
+	key ed25519.PrivateKey
+}
+
+// LoadIdentity reads the identity stored in dir, generating it if there is
+// none yet
+func LoadIdentity(dir string) (*Identity, error) {
+	path := filepath.Join(dir, "identity.pem")
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return generateIdentity(path)
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return &Identity{key: key}, nil
+}
+
+func generateIdentity(path string) (*Identity, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return &Identity{key: key}, nil
+}
+
+// PublicKey returns the key peers verify signatures with
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.key.Public().(ed25519.PublicKey)
+}
+
+// publicKey returns the public identity key of this client, if it has one
+func (c *Client) publicKey() []byte {
+	if c.Identity == nil {
+		return nil
+	}
+	return c.Identity.PublicKey()
+}
+
+// Fingerprint returns the SHA-256 hash of the public key, for users to
+// compare
+func (id *Identity) Fingerprint() string {
+	return keyFingerprint(id.PublicKey())
+}
+
+func keyFingerprint(key []byte) string {
+	if len(key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// signedData returns the fields of p covered by its signature, each
+// preceded by its length
+func signedData(p Packet) []byte {
+	var b bytes.Buffer
+	fields := []string{
+		strconv.Itoa(p.Type), p.User, p.Msg, p.Room, p.To, p.ID,
+		strconv.FormatUint(p.Clock, 10), strconv.FormatInt(p.Time.UnixNano(), 10),
+	}
+	for _, f := range fields {
+		binary.Write(&b, binary.BigEndian, uint32(len(f)))
+		b.WriteString(f)
+	}
+	return b.Bytes()
+}
+
+// sign adds the signature of this user to p, which must be stamped already
+func (c *Client) sign(p *Packet) {
+	if c.Identity == nil {
+		return
+	}
+	p.Key = c.Identity.PublicKey()
+	p.Sig = ed25519.Sign(c.Identity.key, signedData(*p))
+}
+
+// verify tells whether p was signed by the user it claims to come from. The
+// key it was signed with must be the one trusted for that name with :trust,
+// or else the one presented by the peer using that name. Messages of users
+// who are neither trusted nor connected, e.g. replayed by the host after
+// they left, can't be told apart from forgeries, so they are unverified.
+// Clients without an identity don't check signatures.
+func (c *Client) verify(p Packet) ui.Signature {
+	if c.Identity == nil {
+		return ui.SignatureValid
+	}
+	if len(p.Sig) == 0 || len(p.Key) != ed25519.PublicKeySize {
+		return ui.SignatureMissing
+	}
+	if !ed25519.Verify(ed25519.PublicKey(p.Key), signedData(p), p.Sig) {
+		return ui.SignatureMismatch
+	}
+	if c.TrustedKeys != nil {
+		if trusted, ok := c.TrustedKeys.Lookup(p.User); ok {
+			if trusted != keyFingerprint(p.Key) {
+				return ui.SignatureMismatch
+			}
+			return ui.SignatureValid
+		}
+	}
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	if p.User == c.Name {
+		if !bytes.Equal(p.Key, c.Identity.PublicKey()) {
+			return ui.SignatureMismatch
+		}
+		return ui.SignatureValid
+	}
+	for _, peer := range c.peers {
+		if peer.name != p.User || len(peer.key) == 0 {
+			continue
+		}
+		if !bytes.Equal(p.Key, peer.key) {
+			return ui.SignatureMismatch
+		}
+		return ui.SignatureValid
+	}
+	return ui.SignatureUnverified
+}
+
+// verifyKey warns the user if a peer presents an identity key other than
+// the one trusted for its name
+func (c *Client) verifyKey(name string, key []byte) {
+	if c.TrustedKeys == nil {
+		return
+	}
+	trusted, ok := c.TrustedKeys.Lookup(name)
+	if !ok {
+		return
+	}
+	if fp := keyFingerprint(key); fp != trusted {
+		if fp == "" {
+			fp = "none"
+		}
+		c.logToUIf("WARNING: \"%s\" presents identity key %s, but you trusted %s. Someone may be impersonating them!", name, fp, trusted)
+	}
+}
+
+// trustOutHandler pins the identity key of a connected peer to its name.
+// Messages signed with other keys under that name are flagged from then on.
+func trustOutHandler(c *Client, p ui.Packet) {
+	name := commandArg(p.Msg)
+	if name == "" {
+		c.logToUIf(":trust needs a user name\n")
+		return
+	}
+	if c.Identity == nil || c.TrustedKeys == nil {
+		c.logToUIf("messages are not signed")
+		return
+	}
+	var key []byte
+	found := false
+	peersMu.RLock()
+	for _, peer := range c.peers {
+		if peer.name == name {
+			key, found = peer.key, true
+			break
+		}
+	}
+	peersMu.RUnlock()
+	if !found {
+		c.logToUIf("not connected to \"%s\"", name)
+		return
+	}
+	if len(key) == 0 {
+		c.logToUIf("\"%s\" has no identity key; they may run an older lanchat version", name)
+		return
+	}
+	fp := keyFingerprint(key)
+	if err := c.TrustedKeys.Set(name, fp); err != nil {
+		c.logToUIf("could not save trusted key: %v", err)
+		return
+	}
+	c.logToUIf("trusted \"%s\", with identity key %s", name, fp)
+}
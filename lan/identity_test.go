@@ -0,0 +1,189 @@
+package lan
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestLoadIdentity(t *testing.T) {
+	dir := tempDir(t)
+	first, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.PublicKey(), second.PublicKey()) {
+		t.Errorf("expected identity to be reused, got fingerprints %s and %s", first.Fingerprint(), second.Fingerprint())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := tempDir(t)
+	alice, err := LoadIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, err := LoadIdentity(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := newTestClient(false, 0, &NullScanner{})
+	sender.Name = "peer_0"
+	signedAs := func(id *Identity, user string, change func(p *Packet)) Packet {
+		sender.Identity = id
+		p := Packet{User: user, Msg: "hi", Type: MsgTypeChat}
+		sender.stamp(&p)
+		sender.sign(&p)
+		change(&p)
+		return p
+	}
+	signed := func(id *Identity, change func(p *Packet)) Packet {
+		return signedAs(id, "peer_0", change)
+	}
+
+	tests := []struct {
+		name     string
+		pkt      Packet
+		trusted  string // fingerprint trusted for the sender
+		expected ui.Signature
+	}{
+		{"signed by the peer", signed(alice, func(p *Packet) {}), "", ui.SignatureValid},
+		{"unsigned", Packet{User: "peer_0", Msg: "hi"}, "", ui.SignatureMissing},
+		{"altered", signed(alice, func(p *Packet) { p.Msg = "bye" }), "", ui.SignatureMismatch},
+		{"signed by someone else", signed(mallory, func(p *Packet) {}), "", ui.SignatureMismatch},
+		{"signed with the trusted key", signed(alice, func(p *Packet) {}), alice.Fingerprint(), ui.SignatureValid},
+		{"signed with another key than the trusted one", signed(alice, func(p *Packet) {}), mallory.Fingerprint(), ui.SignatureMismatch},
+		{"someone else using my name", signedAs(mallory, "testClient", func(p *Packet) {}), "", ui.SignatureMismatch},
+		{"signed by someone not connected", signedAs(mallory, "peer_9", func(p *Packet) {}), "", ui.SignatureUnverified},
+		{"signed by someone trusted, not connected", signedAs(alice, "peer_9", func(p *Packet) {}), alice.Fingerprint(), ui.SignatureValid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(false, 1, &NullScanner{})
+			c.Identity, err = LoadIdentity(tempDir(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.peers["0"].key = alice.PublicKey()
+			c.TrustedKeys, err = LoadKnownPeers(filepath.Join(tempDir(t), "trusted_keys"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.trusted != "" {
+				c.TrustedKeys.Set(tt.pkt.User, tt.trusted)
+			}
+			if s := c.verify(tt.pkt); s != tt.expected {
+				t.Errorf("expected signature %v, got %v", tt.expected, s)
+			}
+		})
+	}
+}
+
+func TestUnsignedChatFlagged(t *testing.T) {
+	c := newTestClient(false, 1, &NullScanner{})
+	var err error
+	c.Identity, err = LoadIdentity(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleInbound(&c, Packet{User: "peer_0", Msg: "trust me"}, "0")
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ui.Packet{{User: "peer_0", Msg: "trust me", Type: ui.PacketTypeChat, Signature: ui.SignatureMissing}}
+	if err = compareUIPackets(expected, uiPackets); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHistoryVerified(t *testing.T) {
+	alice, err := LoadIdentity(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := newTestClient(false, 0, &NullScanner{})
+	sender.Identity = alice
+	replayed := func(user string) Packet {
+		sender.Name = user
+		p := Packet{User: user, Msg: "earlier", Type: MsgTypeChat}
+		sender.stamp(&p)
+		sender.sign(&p)
+		p.Type = MsgTypeHistory
+		return p
+	}
+
+	c := newTestClient(false, 1, &NullScanner{})
+	c.Identity, err = LoadIdentity(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.peers["0"].key = alice.PublicKey()
+	handleInbound(&c, replayed("peer_0"), "0")
+	// whoever sent it left already
+	handleInbound(&c, replayed("peer_9"), "0")
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uiPackets) != 2 || uiPackets[0].Signature != ui.SignatureValid || uiPackets[1].Signature != ui.SignatureUnverified {
+		t.Errorf("expected history of peer_0 only to be verified, got %+v", uiPackets)
+	}
+}
+
+func TestTrustOutHandler(t *testing.T) {
+	peerKey, err := LoadIdentity(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tempDir(t), "trusted_keys")
+	c := newTestClient(false, 2, &NullScanner{})
+	c.Identity, err = LoadIdentity(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.TrustedKeys, err = LoadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.peers["0"].key = peerKey.PublicKey()
+
+	handleOutbound(&c, ui.Packet{Msg: ":trust peer_0"})
+	handleOutbound(&c, ui.Packet{Msg: ":trust peer_1"})
+	handleOutbound(&c, ui.Packet{Msg: ":trust nobody"})
+	// the peer reconnects with another key
+	c.verifyKey("peer_0", nil)
+
+	trusted, err := LoadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp, ok := trusted.Lookup("peer_0"); !ok || fp != peerKey.Fingerprint() {
+		t.Errorf("expected key of peer_0 to be trusted, got %q", fp)
+	}
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"trusted \"peer_0\", with identity key " + peerKey.Fingerprint(),
+		"\"peer_1\" has no identity key",
+		"not connected to \"nobody\"",
+		"WARNING: \"peer_0\" presents identity key none",
+	}
+	if len(uiPackets) != len(expected) {
+		t.Fatalf("expected %d UI packets, got %+v", len(expected), uiPackets)
+	}
+	for i, p := range uiPackets {
+		if !strings.HasPrefix(p.Msg, expected[i]) {
+			t.Errorf("expected message starting with %q, got %q", expected[i], p.Msg)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package lan
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+// IgnoreList holds the users whose messages are hidden with :ignore. Users
+// are told apart by the fingerprint of their identity key, or by their IP
+// address if they have none, so that changing names doesn't get them out of
+// it. It is stored as a text file with one user per line: the fingerprint or
+// address, followed by a space and the name they had when ignored, which may
+// contain spaces itself.
+type IgnoreList struct {
+	path  string
+	mu    sync.Mutex
+	users map[string]string
+}
+
+func LoadIgnoreList(path string) (*IgnoreList, error) {
+	l := &IgnoreList{path: path, users: make(map[string]string)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) == 2 && fields[0] != "" && fields[1] != "" {
+			l.users[fields[0]] = fields[1]
+		}
+	}
+	return l, scanner.Err()
+}
+
+// Add ignores the user with the given key, known by name
+func (l *IgnoreList) Add(key, name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.users[key] = name
+	return l.save()
+}
+
+// Remove stops ignoring the user with the given key, returning whether they
+// were ignored
+func (l *IgnoreList) Remove(key string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.users[key]; !ok {
+		return false, nil
+	}
+	delete(l.users, key)
+	return true, l.save()
+}
+
+// Ignored returns whether the user with the given key is ignored
+func (l *IgnoreList) Ignored(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.users[key]
+	return ok
+}
+
+// Find returns the key of an ignored user, given the name they had when
+// ignored
+func (l *IgnoreList) Find(name string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, n := range l.users {
+		if n == name {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// Users returns the names ignored users had when ignored, by key
+func (l *IgnoreList) Users() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[string]string, len(l.users))
+	for key, name := range l.users {
+		out[key] = name
+	}
+	return out
+}
+
+func (l *IgnoreList) save() error {
+	var b strings.Builder
+	for key, name := range l.users {
+		fmt.Fprintf(&b, "%s %s\n", key, name)
+	}
+	return ioutil.WriteFile(l.path, []byte(b.String()), 0600)
+}
+
+// ignoreKey returns the key a peer is ignored by: the fingerprint of its
+// identity key, or else its IP address
+func ignoreKey(pid peerID, p *peer) string {
+	if fp := keyFingerprint(p.key); fp != "" {
+		return fp
+	}
+	return peerIP(pid)
+}
+
+// ignoring returns whether p was sent by an ignored user. Signed messages are
+// told apart by their key; others by the peer which stamped them, or else by
+// the name they were sent under.
+func (c *Client) ignoring(p Packet) bool {
+	if c.Ignored == nil {
+		return false
+	}
+	if len(p.Sig) > 0 && len(p.Key) == ed25519.PublicKeySize && ed25519.Verify(ed25519.PublicKey(p.Key), signedData(p), p.Sig) {
+		return c.Ignored.Ignored(keyFingerprint(p.Key))
+	}
+	node := senderNode(p.ID)
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	for pid, peer := range c.peers {
+		if (node != "" && peer.id == node) || (node == "" && peer.name == p.User) {
+			return c.Ignored.Ignored(ignoreKey(pid, peer))
+		}
+	}
+	return false
+}
+
+// connectedKey returns the key of the connected peer with the given name.
+// Callers must hold peersMu.
+func (c *Client) connectedKey(name string) (string, bool) {
+	for pid, peer := range c.peers {
+		if peer.name == name {
+			return ignoreKey(pid, peer), true
+		}
+	}
+	return "", false
+}
+
+func ignoreOutHandler(c *Client, p ui.Packet) {
+	name := commandArg(p.Msg)
+	if name == "" {
+		c.logToUIf(":ignore needs a user name")
+		return
+	}
+	if c.Ignored == nil {
+		c.logToUIf("ignoring users is disabled")
+		return
+	}
+	if name == c.Name {
+		c.logToUIf("you can't ignore yourself")
+		return
+	}
+	peersMu.RLock()
+	key, ok := c.connectedKey(name)
+	peersMu.RUnlock()
+	if !ok {
+		c.logToUIf("not connected to \"%s\"", name)
+		return
+	}
+	if c.Ignored.Ignored(key) {
+		c.logToUIf("already ignoring \"%s\"", name)
+		return
+	}
+	if err := c.Ignored.Add(key, name); err != nil {
+		c.logToUIf("could not save ignored users: %v", err)
+		return
+	}
+	c.logToUIf("ignoring \"%s\"; run \":unignore %s\" to see their messages again", name, name)
+}
+
+// unignoreOutHandler shows the messages of an ignored user again, given their
+// current name or the one they had when ignored
+func unignoreOutHandler(c *Client, p ui.Packet) {
+	name := commandArg(p.Msg)
+	if name == "" {
+		c.logToUIf(":unignore needs a user name")
+		return
+	}
+	if c.Ignored == nil {
+		c.logToUIf("ignoring users is disabled")
+		return
+	}
+	peersMu.RLock()
+	key, ok := c.connectedKey(name)
+	peersMu.RUnlock()
+	if !ok || !c.Ignored.Ignored(key) {
+		key, ok = c.Ignored.Find(name)
+	}
+	if !ok {
+		c.logToUIf("not ignoring \"%s\"", name)
+		return
+	}
+	if _, err := c.Ignored.Remove(key); err != nil {
+		c.logToUIf("could not save ignored users: %v", err)
+		return
+	}
+	c.logToUIf("no longer ignoring \"%s\"", name)
+}
+
+// ignoredOutHandler lists the ignored users, along with the names they use
+// now, if connected
+func ignoredOutHandler(c *Client, p ui.Packet) {
+	if c.Ignored == nil {
+		c.logToUIf("ignoring users is disabled")
+		return
+	}
+	users := c.Ignored.Users()
+	if len(users) == 0 {
+		c.logToUIf("not ignoring anyone")
+		return
+	}
+	current := make(map[string]string)
+	peersMu.RLock()
+	for pid, peer := range c.peers {
+		current[ignoreKey(pid, peer)] = peer.name
+	}
+	peersMu.RUnlock()
+	lines := make([]string, 0, len(users))
+	for key, name := range users {
+		line := fmt.Sprintf("%s (%s)", name, key)
+		if now, ok := current[key]; ok && now != name {
+			line += fmt.Sprintf(", now \"%s\"", now)
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	c.logToUIf("ignored users:\n%s", strings.Join(lines, "\n"))
+}
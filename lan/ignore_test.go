@@ -0,0 +1,106 @@
+package lan
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestIgnoreList(t *testing.T) {
+	path := filepath.Join(tempDir(t), "ignored")
+	l, err := LoadIgnoreList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Add("abc123", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Add("10.0.0.5", "bot"); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Add("def456", "Jon Snow"); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := l.Remove("10.0.0.5"); err != nil || !removed {
+		t.Fatalf("expected bot to be removed, got %v, %v", removed, err)
+	}
+
+	l, err = LoadIgnoreList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Ignored("abc123") || !l.Ignored("def456") || l.Ignored("10.0.0.5") {
+		t.Errorf("expected bob and Jon Snow to be ignored, got %v", l.Users())
+	}
+	if key, ok := l.Find("Jon Snow"); !ok || key != "def456" {
+		t.Errorf("expected to find Jon Snow, got %q", key)
+	}
+	if key, ok := l.Find("bob"); !ok || key != "abc123" {
+		t.Errorf("expected to find bob, got %q", key)
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	bob, err := LoadIdentity(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := newTestClient(false, 0, &NullScanner{})
+	sender.id = "id0"
+	sender.Identity = bob
+	signed := func(user, msg string, typ int) Packet {
+		sender.Name = user
+		p := Packet{User: user, Msg: msg, Type: typ}
+		sender.stamp(&p)
+		sender.sign(&p)
+		return p
+	}
+
+	c := newTestClient(false, 2, &NullScanner{})
+	c.peers["0"].id = "id0"
+	c.peers["0"].key = bob.PublicKey()
+	c.peers["1"].id = "id1"
+	c.Ignored, err = LoadIgnoreList(filepath.Join(tempDir(t), "ignored"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handleOutbound(&c, ui.Packet{Msg: ":ignore peer_0"})
+	handleOutbound(&c, ui.Packet{Msg: ":ignore peer_1"})
+	// peer_0 changes their name
+	handleInbound(&c, Packet{Type: MsgTypeCmd, Msg: ":id rob"}, "0")
+	handleInbound(&c, signed("rob", "hi", MsgTypeChat), "0")
+	handleInbound(&c, signed("rob", "psst", MsgTypePrivate), "0")
+	handleInbound(&c, Packet{User: "peer_1", Msg: "beep", ID: "id1-1"}, "1")
+	handleOutbound(&c, ui.Packet{Msg: ":ignored"})
+	handleOutbound(&c, ui.Packet{Msg: ":unignore rob"})
+	handleOutbound(&c, ui.Packet{Msg: ":unignore peer_1"})
+	handleInbound(&c, signed("rob", "hi again", MsgTypeChat), "0")
+
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"ignoring \"peer_0\"",
+		"ignoring \"peer_1\"",
+		"user \"peer_0\" changed their name to \"rob\"",
+		"ignored users:\npeer_0 (" + bob.Fingerprint() + "), now \"rob\"\npeer_1 (1)",
+		"no longer ignoring \"rob\"",
+		"no longer ignoring \"peer_1\"",
+		"hi again",
+	}
+	if len(uiPackets) != len(expected) {
+		t.Fatalf("expected %d UI packets, got %+v", len(expected), uiPackets)
+	}
+	for i, p := range uiPackets {
+		if !strings.HasPrefix(p.Msg, expected[i]) {
+			t.Errorf("expected message starting with %q, got %q", expected[i], p.Msg)
+		}
+	}
+	if len(c.Ignored.Users()) != 0 {
+		t.Errorf("expected no ignored users, got %v", c.Ignored.Users())
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"testing"
 	"time"
 
 	"github.com/MarcPer/lanchat/ui"
@@ -27,6 +28,9 @@ func newTestClient(host bool, numPeers int, scanner NetScanner) Client {
 	return Client{
 		Name:     "testClient",
 		HostPort: 6776,
+		host:     host,
+		online:   true,
+		id:       "testClientID",
 		ToUI:     make(chan ui.Packet, 10),
 		FromUI:   make(chan ui.Packet, 10),
 		peers:    peers,
@@ -72,3 +76,27 @@ func readUI(c *Client) (out []ui.Packet, err error) {
 		}
 	}
 }
+
+func comparePeerInfo(expected []PeerInfo, got []PeerInfo) error {
+	if len(expected) != len(got) {
+		return fmt.Errorf("expected %d peers, got %d", len(expected), len(got))
+	}
+	for i, p := range got {
+		if p != expected[i] {
+			return fmt.Errorf("expected peer %d to be %+v, got %+v", i, expected[i], p)
+		}
+	}
+	return nil
+}
+
+// waitFor fails the test if cond doesn't hold within a second
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
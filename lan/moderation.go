@@ -0,0 +1,268 @@
+package lan
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// peerIP returns the IP address of a peer, given the ID of its connection
+func peerIP(pid peerID) string {
+	host, _, err := net.SplitHostPort(string(pid))
+	if err != nil {
+		return string(pid)
+	}
+	return host
+}
+
+// senderNode returns the node ID of the peer which sent a message, given
+// the message ID
+func senderNode(id string) string {
+	if i := strings.LastIndex(id, "-"); i > 0 {
+		return id[:i]
+	}
+	return ""
+}
+
+// kickUser disconnects a user, optionally saying why
+func kickUser(c *Client, by, cmd string) error {
+	args := strings.SplitN(cmd, " ", 3)
+	if len(args) < 2 || args[1] == "" {
+		return fmt.Errorf(":kick needs a user name")
+	}
+	peersMu.RLock()
+	owner := c.owns(args[1])
+	peersMu.RUnlock()
+	if owner {
+		return fmt.Errorf("\"%s\" owns the chat", args[1])
+	}
+	msg := fmt.Sprintf("\"%s\" was kicked by \"%s\"", args[1], by)
+	if len(args) == 3 && strings.TrimSpace(args[2]) != "" {
+		msg += fmt.Sprintf(" (%s)", strings.TrimSpace(args[2]))
+	}
+	if !c.kick(args[1], "", msg) {
+		return fmt.Errorf("not connected to \"%s\"", args[1])
+	}
+	return nil
+}
+
+// kick disconnects the peers with the given name, or connecting from the
+// given IP address, telling everyone why with msg. Peers drop their own
+// connections to them as well. It returns whether anyone was kicked.
+func (c *Client) kick(name, ip, msg string) bool {
+	var kicked []peerID
+	peersMu.Lock()
+	for pid, peer := range c.peers {
+		if (name != "" && peer.name == name) || (ip != "" && peerIP(pid) == ip) {
+			kicked = append(kicked, pid)
+		}
+	}
+	for _, pid := range kicked {
+		peer := c.peers[pid]
+		c.sendAll(Packet{User: c.Name, Type: MsgTypeKick, Target: &PeerInfo{ID: peer.id, Name: peer.name}, Msg: msg}, "")
+	}
+	peersMu.Unlock()
+	for _, pid := range kicked {
+		c.cleanPeer(pid)
+	}
+	if len(kicked) > 0 {
+		c.logToUI(msg)
+	}
+	return len(kicked) > 0
+}
+
+func kickInHandler(c *Client, p Packet, from peerID) {
+	if p.Target == nil || !c.fromHost(from) {
+		return
+	}
+	var drop []peerID
+	peersMu.Lock()
+	self := p.Target.ID == c.id
+	if self {
+		// kicked clients stay disconnected, instead of looking for a host
+		// again
+		c.kicked = true
+	}
+	for pid, peer := range c.peers {
+		if self || peer.id == p.Target.ID {
+			drop = append(drop, pid)
+		}
+	}
+	peersMu.Unlock()
+	for _, pid := range drop {
+		c.cleanPeer(pid)
+	}
+	if self {
+		c.logToUIf("%s; restart lanchat to join again", p.Msg)
+		return
+	}
+	c.logToUI(p.Msg)
+}
+
+// banUser disconnects a user, or everyone at an IP address, and refuses them
+// from then on, or for the given time
+func banUser(c *Client, by, cmd string) error {
+	args := strings.Fields(cmd)
+	if len(args) < 2 || len(args) > 3 {
+		return fmt.Errorf(":ban needs a user name or IP address, and optionally a duration, received %v", args[1:])
+	}
+	var d time.Duration
+	if len(args) == 3 {
+		var err error
+		if d, err = time.ParseDuration(args[2]); err != nil || d <= 0 {
+			return fmt.Errorf("invalid ban duration %q; use e.g. 30m or 2h", args[2])
+		}
+	}
+	if c.Bans == nil {
+		return fmt.Errorf("bans are disabled")
+	}
+	target, name, ip := args[1], args[1], ""
+	if net.ParseIP(target) != nil {
+		name, ip = "", target
+	} else {
+		// the address banned users connect from is banned as well, so they
+		// don't just come back under another name
+		peersMu.RLock()
+		if c.owns(name) {
+			peersMu.RUnlock()
+			return fmt.Errorf("\"%s\" owns the chat", name)
+		}
+		for pid, peer := range c.peers {
+			if peer.name == name {
+				ip = peerIP(pid)
+			}
+		}
+		peersMu.RUnlock()
+	}
+	if err := c.Bans.Add(target, ip, d); err != nil {
+		return fmt.Errorf("could not save ban: %v", err)
+	}
+	msg := fmt.Sprintf("\"%s\" was banned by \"%s\"", target, by)
+	if d > 0 {
+		msg += fmt.Sprintf(" for %v", d)
+	}
+	if !c.kick(name, ip, msg) {
+		c.broadcast(Packet{User: c.Name, Type: MsgTypeAdmin, Msg: msg}, "")
+		c.logToUI(msg)
+	}
+	return nil
+}
+
+// unbanUser lifts the ban of a user or IP address
+func unbanUser(c *Client, by, cmd string) error {
+	target := commandArg(cmd)
+	if target == "" {
+		return fmt.Errorf(":unban needs a user name or IP address")
+	}
+	if c.Bans == nil {
+		return fmt.Errorf("bans are disabled")
+	}
+	banned, err := c.Bans.Remove(target)
+	if err != nil {
+		return fmt.Errorf("could not save bans: %v", err)
+	}
+	if !banned {
+		return fmt.Errorf("\"%s\" is not banned", target)
+	}
+	msg := fmt.Sprintf("\"%s\" was unbanned by \"%s\"", target, by)
+	c.broadcast(Packet{User: c.Name, Type: MsgTypeAdmin, Msg: msg}, "")
+	c.logToUI(msg)
+	return nil
+}
+
+// banned returns whether connections from the given address are refused
+func (c *Client) banned(addr net.Addr) bool {
+	if c.Bans == nil {
+		return false
+	}
+	return c.Bans.Banned("", peerIP(peerID(addr.String())))
+}
+
+// muteUser keeps a user from sending chat and private messages
+func muteUser(c *Client, by, cmd string) error {
+	return c.setMuted(by, commandArg(cmd), true)
+}
+
+// unmuteUser lets a muted user send messages again
+func unmuteUser(c *Client, by, cmd string) error {
+	return c.setMuted(by, commandArg(cmd), false)
+}
+
+// setMuted mutes or unmutes the user with the given name. Everyone is told,
+// so that peers discard their messages too.
+func (c *Client) setMuted(by, name string, muted bool) error {
+	action, typ := "mute", MsgTypeMute
+	if !muted {
+		action, typ = "unmute", MsgTypeUnmute
+	}
+	if name == "" {
+		return fmt.Errorf(":%s needs a user name", action)
+	}
+	peersMu.Lock()
+	if c.owns(name) {
+		peersMu.Unlock()
+		return fmt.Errorf("\"%s\" owns the chat", name)
+	}
+	var target *PeerInfo
+	for _, peer := range c.peers {
+		if peer.name == name {
+			target = &PeerInfo{ID: peer.id, Name: peer.name}
+		}
+	}
+	if target == nil {
+		peersMu.Unlock()
+		return fmt.Errorf("not connected to \"%s\"", name)
+	}
+	c.mute(target.ID, muted)
+	msg := fmt.Sprintf("\"%s\" was %sd by \"%s\"", name, action, by)
+	c.sendAll(Packet{User: c.Name, Type: typ, Target: target, Msg: msg}, "")
+	peersMu.Unlock()
+	c.logToUI(msg)
+	return nil
+}
+
+// mute records whether the peer with the given node ID is muted. Callers
+// must hold peersMu.
+func (c *Client) mute(id string, muted bool) {
+	if !muted {
+		delete(c.muted, id)
+		return
+	}
+	if c.muted == nil {
+		c.muted = make(map[string]bool)
+	}
+	c.muted[id] = true
+}
+
+func muteInHandler(c *Client, p Packet, from peerID) {
+	if p.Target == nil || !c.fromHost(from) {
+		return
+	}
+	peersMu.Lock()
+	c.mute(p.Target.ID, p.Type == MsgTypeMute)
+	peersMu.Unlock()
+	c.logToUI(p.Msg)
+}
+
+// mutedSender returns whether the peer on the other end of the given
+// connection was muted. Only the host relays messages, and it drops those of
+// muted peers, so the connection a message arrives on tells who sent it,
+// whatever its ID claims.
+func (c *Client) mutedSender(from peerID) bool {
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	peer, ok := c.peers[from]
+	return ok && c.muted[peer.id]
+}
+
+// isMuted returns whether this user was muted, telling them so
+func (c *Client) isMuted() bool {
+	peersMu.RLock()
+	muted := c.muted[c.id]
+	peersMu.RUnlock()
+	if muted {
+		c.logToUIf("you are muted")
+	}
+	return muted
+}
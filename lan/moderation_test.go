@@ -0,0 +1,214 @@
+package lan
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestKickOutHandler(t *testing.T) {
+	c := newTestClient(true, 2, &NullScanner{})
+	c.peers["0"].id = "id0"
+	handleOutbound(&c, ui.Packet{Msg: ":kick peer_0 flooding"})
+
+	if _, ok := c.peers["0"]; ok {
+		t.Error("expected kicked peer to be disconnected")
+	}
+	pkts, err := readFromPeer(&c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "\"peer_0\" was kicked by \"testClient\" (flooding)"
+	if len(pkts) < 1 || pkts[0].Type != MsgTypeKick || pkts[0].Target.ID != "id0" || pkts[0].Msg != msg {
+		t.Errorf("expected peers to be told about the kick, got %+v", pkts)
+	}
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = compareUIPackets([]ui.Packet{{Type: ui.PacketTypeAdmin, Msg: msg}}, uiPackets); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestModerationNeedsOperator(t *testing.T) {
+	for _, cmd := range []string{":kick peer_0", ":ban peer_0", ":mute peer_0"} {
+		t.Run(cmd, func(t *testing.T) {
+			c := newTestClient(false, 1, &NullScanner{})
+			handleOutbound(&c, ui.Packet{Msg: cmd})
+			if _, ok := c.peers["0"]; !ok {
+				t.Error("expected peer to stay connected")
+			}
+			uiPackets, err := readUI(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(uiPackets) != 1 || uiPackets[0].Msg != strings.Fields(cmd)[0]+" needs the operator role" {
+				t.Errorf("expected moderation to be refused, got %+v", uiPackets)
+			}
+		})
+	}
+}
+
+func TestKickInHandler(t *testing.T) {
+	c := newTestClient(false, 3, &NullScanner{})
+	c.peers["0"].host = true
+	c.peers["1"].id = "id1"
+
+	// only the host kicks peers
+	handleInbound(&c, Packet{Type: MsgTypeKick, Target: &PeerInfo{ID: "id1"}, Msg: "kicked"}, "2")
+	if len(c.peers) != 3 {
+		t.Fatalf("expected kick from a peer to be ignored, got %d peers", len(c.peers))
+	}
+	handleInbound(&c, Packet{Type: MsgTypeKick, Target: &PeerInfo{ID: "id1"}, Msg: "kicked"}, "0")
+	if _, ok := c.peers["1"]; ok || len(c.peers) != 2 {
+		t.Errorf("expected connection to the kicked peer to be dropped, got %+v", c.peers)
+	}
+
+	handleInbound(&c, Packet{Type: MsgTypeKick, Target: &PeerInfo{ID: c.id}, Msg: "you were kicked"}, "0")
+	if len(c.peers) != 0 || !c.kicked {
+		t.Errorf("expected kicked client to disconnect from everyone, got %+v", c.peers)
+	}
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ui.Packet{
+		{Type: ui.PacketTypeAdmin, Msg: "kicked"},
+		{Type: ui.PacketTypeAdmin, Msg: "you were kicked; restart lanchat to join again"},
+	}
+	if err = compareUIPackets(expected, uiPackets); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBanOutHandler(t *testing.T) {
+	c := newTestClient(true, 2, &NullScanner{})
+	var err error
+	c.Bans, err = LoadBanList(filepath.Join(tempDir(t), "bans"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.peers["10.0.0.2:4000"] = c.peers["0"]
+	delete(c.peers, "0")
+	handleOutbound(&c, ui.Packet{Msg: ":ban peer_0 1h"})
+	handleOutbound(&c, ui.Packet{Msg: ":ban 10.0.0.5"})
+	handleOutbound(&c, ui.Packet{Msg: ":ban peer_1 forever"})
+
+	if len(c.peers) != 1 {
+		t.Errorf("expected banned peer to be disconnected, got %+v", c.peers)
+	}
+	for _, addr := range []string{"10.0.0.2:5000", "10.0.0.5:5000"} {
+		a, _ := net.ResolveTCPAddr("tcp", addr)
+		if !c.banned(a) {
+			t.Errorf("expected connections from %s to be refused", addr)
+		}
+	}
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ui.Packet{
+		{Type: ui.PacketTypeAdmin, Msg: "\"peer_0\" was banned by \"testClient\" for 1h0m0s"},
+		{Type: ui.PacketTypeAdmin, Msg: "\"10.0.0.5\" was banned by \"testClient\""},
+		{Type: ui.PacketTypeAdmin, Msg: "invalid ban duration \"forever\"; use e.g. 30m or 2h"},
+	}
+	if err = compareUIPackets(expected, uiPackets); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandshakeWhileBanned(t *testing.T) {
+	host := newTestClient(true, 0, &NullScanner{})
+	var err error
+	host.Bans, err = LoadBanList(filepath.Join(tempDir(t), "bans"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.Bans.Add("guest", "", 0)
+	guest := newTestClient(false, 0, &NullScanner{})
+	guest.Name = "guest"
+	guest.id = "guestID"
+
+	conn, err := net.Dial("tcp", listen(t, &host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, err = guest.handshake(conn); err == nil || err.Error() != "connection rejected: you are banned from this chat" {
+		t.Errorf("expected banned guest to be rejected, got %v", err)
+	}
+}
+
+func TestMute(t *testing.T) {
+	host := newTestClient(true, 2, &NullScanner{})
+	host.peers["0"].id = "id0"
+	handleOutbound(&host, ui.Packet{Msg: ":mute peer_0"})
+	pkts, err := readFromPeer(&host, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 1 || pkts[0].Type != MsgTypeMute || pkts[0].Target.ID != "id0" {
+		t.Fatalf("expected peers to be told about the mute, got %+v", pkts)
+	}
+
+	// messages of muted peers are discarded, and not relayed by the host
+	handleInbound(&host, Packet{User: "peer_0", Msg: "spam", ID: "id0-1"}, "0")
+	handleInbound(&host, Packet{User: "peer_0", Msg: "spam", ID: "someone-else-1"}, "0")
+	if pkts, _ = readFromPeer(&host, 1); len(pkts) != 0 {
+		t.Errorf("expected messages of muted peer not to be relayed, got %+v", pkts)
+	}
+
+	peer := newTestClient(false, 2, &NullScanner{})
+	peer.peers["0"].host = true
+	peer.peers["1"].id = "id1"
+	handleInbound(&peer, Packet{Type: MsgTypeMute, Target: &PeerInfo{ID: "id1", Name: "peer_1"}, Msg: "\"peer_1\" was muted by \"peer_0\""}, "0")
+	handleInbound(&peer, Packet{User: "peer_1", Msg: "spam", ID: "id1-1"}, "1")
+	handleInbound(&peer, Packet{User: "peer_1", Msg: "spam", ID: "forged-1"}, "1")
+	handleInbound(&peer, Packet{Type: MsgTypeMute, Target: &PeerInfo{ID: peer.id, Name: peer.Name}, Msg: "\"testClient\" was muted by \"peer_0\""}, "0")
+	handleOutbound(&peer, ui.Packet{Msg: "let me talk"})
+	handleInbound(&peer, Packet{Type: MsgTypeUnmute, Target: &PeerInfo{ID: "id1", Name: "peer_1"}, Msg: "\"peer_1\" was unmuted by \"peer_0\""}, "0")
+	handleInbound(&peer, Packet{User: "peer_1", Msg: "sorry", ID: "id1-2"}, "1")
+
+	uiPackets, err := readUI(&peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ui.Packet{
+		{Type: ui.PacketTypeAdmin, Msg: "\"peer_1\" was muted by \"peer_0\""},
+		{Type: ui.PacketTypeAdmin, Msg: "\"testClient\" was muted by \"peer_0\""},
+		{Type: ui.PacketTypeAdmin, Msg: "you are muted"},
+		{Type: ui.PacketTypeAdmin, Msg: "\"peer_1\" was unmuted by \"peer_0\""},
+		{Type: ui.PacketTypeChat, User: "peer_1", Msg: "sorry", ID: "id1-2"},
+	}
+	if err = compareUIPackets(expected, uiPackets); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMuteLateJoiner(t *testing.T) {
+	host := newTestClient(true, 1, &NullScanner{})
+	host.peers["0"].id = "id0"
+	handleOutbound(&host, ui.Packet{Msg: ":mute peer_0"})
+	members := host.memberList("")
+	if len(members) != 2 || members[0].Muted || !members[1].Muted {
+		t.Fatalf("expected peer_0 to be listed as muted, got %+v", members)
+	}
+
+	// a peer joining after the mute learns about it from the member list
+	peer := newTestClient(false, 2, &NullScanner{})
+	peer.peers["0"].host = true
+	peer.peers["1"].id = "id0"
+	handleInbound(&peer, Packet{Type: MsgTypeMembers, Peers: members}, "0")
+	handleInbound(&peer, Packet{User: "peer_0", Msg: "spam", ID: "id0-1"}, "1")
+	handleInbound(&peer, Packet{User: "peer_0", Type: MsgTypeFileOffer, ID: "id0-2", File: &File{ID: "id0-2", Name: "spam.exe", Size: 1}}, "1")
+	if uiPackets, _ := readUI(&peer); len(uiPackets) != 0 {
+		t.Errorf("expected messages of muted peer to be discarded, got %+v", uiPackets)
+	}
+	if len(peer.files.offers) != 0 {
+		t.Errorf("expected file offers of muted peer to be discarded, got %+v", peer.files.offers)
+	}
+}
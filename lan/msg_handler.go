@@ -2,6 +2,8 @@ package lan
 
 import (
 	"fmt"
+	"net"
+	"sort"
 	"strings"
 
 	"github.com/MarcPer/lanchat/ui"
@@ -13,20 +15,56 @@ type MsgHandler struct {
 	in    InboundHandler
 	out   OutboundHandler
 	usage string
+	role  Role // needed to run the command
 }
 
-var MsgHandlers = map[string]MsgHandler{
-	":help": {noOpInHandler, helpOutHandler, "Show available commands"},
-	":id":   {idInHandler, idOutHandler, "Change username. Example: \":id my_new_name\""},
-}
+var MsgHandlers map[string]MsgHandler
 
 var helpMessage string
 
 func init() {
+	// handlers are assigned here rather than in the declaration, as they
+	// indirectly refer to MsgHandlers themselves
+	MsgHandlers = map[string]MsgHandler{
+		":help":        {noOpInHandler, helpOutHandler, "Show available commands", RoleMember},
+		":id":          {idInHandler, idOutHandler, "Change username. Example: \":id my_new_name\"", RoleMember},
+		":fingerprint": {noOpInHandler, fingerprintOutHandler, "Show the certificate and identity key fingerprints of yourself and connected peers, to compare them in person", RoleMember},
+		":join":        {joinInHandler, joinOutHandler, "Join a room and send messages to it. Example: \":join backend\"", RoleMember},
+		":leave":       {leaveInHandler, leaveOutHandler, "Leave a room. Example: \":leave backend\"", RoleMember},
+		":rooms":       {noOpInHandler, roomsOutHandler, "List rooms and their members", RoleMember},
+		":msg":         {noOpInHandler, msgOutHandler, "Send a private message. Example: \":msg jon see you at lunch\"", RoleMember},
+		":reply":       {noOpInHandler, replyOutHandler, "Reply privately to the last private message received. Example: \":reply sounds good\"", RoleMember},
+		":send":        {noOpInHandler, sendOutHandler, "Offer a file to a user, or to everyone. Example: \":send jon /tmp/server.log\", \":send all notes.txt\"", RoleMember},
+		":accept":      {noOpInHandler, acceptOutHandler, "Download the last file offered to you, or the one with the given name. Example: \":accept server.log\"", RoleMember},
+		":reject":      {noOpInHandler, rejectOutHandler, "Refuse the last file offered to you, or the one with the given name. Example: \":reject server.log\"", RoleMember},
+		":away":        {noOpInHandler, awayOutHandler, "Let others know you are away, optionally saying why. Example: \":away lunch\"", RoleMember},
+		":busy":        {noOpInHandler, busyOutHandler, "Let others know you are busy. Example: \":busy in a meeting\"", RoleMember},
+		":back":        {noOpInHandler, backOutHandler, "Let others know you are back, after \":away\" or \":busy\"", RoleMember},
+		":trust":       {noOpInHandler, trustOutHandler, "Trust the identity key a user has now, flagging messages signed with other keys under their name. Example: \":trust jon\"", RoleMember},
+		":ignore":      {noOpInHandler, ignoreOutHandler, "Hide messages from a user, even after they change their name. Only you are affected. Example: \":ignore jon\"", RoleMember},
+		":unignore":    {noOpInHandler, unignoreOutHandler, "Show messages from an ignored user again. Example: \":unignore jon\"", RoleMember},
+		":ignored":     {noOpInHandler, ignoredOutHandler, "List ignored users", RoleMember},
+		":kick":        {onHost(kickUser), viaHost(kickUser), "Disconnect a user, optionally saying why. Example: \":kick jon flooding\"", RoleOperator},
+		":ban":         {onHost(banUser), viaHost(banUser), "Disconnect a user, or everyone at an IP address, and refuse them from now on or for the given time. Example: \":ban jon 2h\"", RoleOperator},
+		":unban":       {onHost(unbanUser), viaHost(unbanUser), "Lift the ban of a user or IP address. Example: \":unban jon\"", RoleOperator},
+		":mute":        {onHost(muteUser), viaHost(muteUser), "Keep a user from sending messages. Example: \":mute jon\"", RoleOperator},
+		":unmute":      {onHost(unmuteUser), viaHost(unmuteUser), "Let a muted user send messages again. Example: \":unmute jon\"", RoleOperator},
+		":op":          {onHost(opUser), viaHost(opUser), "Make a user an operator, allowed to kick, ban and mute others. Example: \":op jon\"", RoleOwner},
+		":deop":        {onHost(deopUser), viaHost(deopUser), "Take the operator role away from a user. Example: \":deop jon\"", RoleOwner},
+		":who":         {noOpInHandler, whoOutHandler, "List everyone in the chat, with their address, status and lanchat version", RoleMember},
+		":ping":        {noOpInHandler, pingOutHandler, "Measure the round-trip time to a user. Example: \":ping jon\"", RoleMember},
+		":receipts":    {noOpInHandler, receiptsOutHandler, "Show who received and read a message you sent, given part of it, or the last one. Example: \":receipts lunch\"", RoleMember},
+	}
+
+	keys := make([]string, 0, len(MsgHandlers))
+	for key := range MsgHandlers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 	var b strings.Builder
 	b.WriteString("All commands start with a colon (:). Available commands:\n")
-	for key, h := range MsgHandlers {
-		b.WriteString(fmt.Sprintf("%-10s\t%s\n", key, h.usage))
+	for _, key := range keys {
+		b.WriteString(fmt.Sprintf("%-10s\t%s\n", key, MsgHandlers[key].usage))
 	}
 	helpMessage = b.String()
 }
@@ -40,24 +78,99 @@ func idInHandler(c *Client, p Packet, from peerID) {
 		c.ToUI <- ui.Packet{Type: ui.PacketTypeAdmin, Msg: fmt.Sprintf(":id needs a single, non-empty argument, received %v\n", args[1:])}
 		return
 	}
-	peersMu.RLock()
-	defer peersMu.RUnlock()
-	if peer, ok := c.peers[from]; ok {
-		var msg string
-		if peer.name == "" {
-			msg = fmt.Sprintf("user \"%s\" connected", args[1])
-			c.transmit(Packet{Type: MsgTypeCmd, Msg: ":id " + c.Name}, from)
-		} else if peer.name == args[1] {
-			// nothing to do
-			return
-		} else {
-			msg = fmt.Sprintf("user \"%s\" changed their name to \"%s\"", peer.name, args[1])
+	peersMu.Lock()
+	// every peer receives :id directly from the user, so the resulting
+	// admin message is not forwarded to others
+	peer, ok := c.peers[from]
+	if !ok || peer.name == args[1] {
+		// nothing to do
+		peersMu.Unlock()
+		return
+	}
+	if c.host && c.nameTaken(args[1], from) {
+		// the requester may not know everyone yet, or someone else may have
+		// taken the name at the same time; it is told to change it back
+		c.transmit(Packet{User: c.Name, Type: MsgTypeName, Name: peer.name, Msg: fmt.Sprintf("the name \"%s\" is taken", args[1])}, from)
+		peersMu.Unlock()
+		return
+	}
+	msg := fmt.Sprintf("user \"%s\" changed their name to \"%s\"", peer.name, args[1])
+	peer.name = args[1]
+	c.peersChanged()
+	c.sendMembers()
+	peersMu.Unlock()
+	c.ToUI <- ui.Packet{Msg: msg, Type: ui.PacketTypeAdmin}
+}
+
+// membersInHandler stores the member list distributed by the host, along
+// with the operators it named and the peers it muted. Lists from anyone but
+// the host are ignored.
+func membersInHandler(c *Client, p Packet, from peerID) {
+	if !c.fromHost(from) {
+		return
+	}
+	peersMu.Lock()
+	defer peersMu.Unlock()
+	c.members = make([]PeerInfo, 0, len(p.Peers))
+	c.roles = make(map[string]Role)
+	c.muted = mutedMembers(p.Peers)
+	for _, m := range p.Peers {
+		m.Addr = resolveAddr(m.Addr, from)
+		c.members = append(c.members, m)
+		if m.Role == RoleOperator && m.Key != "" {
+			c.roles[m.Key] = m.Role
 		}
-		peer.name = args[1]
-		c.ToUI <- ui.Packet{Msg: msg, Type: ui.PacketTypeAdmin}
-		c.broadcast(Packet{Type: MsgTypeAdmin, Msg: msg}, from)
 	}
+	c.peersChanged()
+}
 
+// mutedMembers returns the node IDs of the members the host muted, so that
+// peers joining after a mute discard their messages too
+func mutedMembers(members []PeerInfo) map[string]bool {
+	muted := make(map[string]bool)
+	for _, m := range members {
+		if m.Muted {
+			muted[m.ID] = true
+		}
+	}
+	return muted
+}
+
+// memberList lists this client, followed by every identified peer except the
+// one given, in the order they connected; see elect. Callers must hold
+// peersMu.
+func (c *Client) memberList(except peerID) []PeerInfo {
+	peers := make([]*peer, 0, len(c.peers))
+	for pid, p := range c.peers {
+		if pid != except && p.id != "" {
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if !peers[i].since.Equal(peers[j].since) {
+			return peers[i].since.Before(peers[j].since)
+		}
+		return peers[i].id < peers[j].id
+	})
+	out := []PeerInfo{c.self()}
+	for _, p := range peers {
+		out = append(out, PeerInfo{ID: p.id, Name: p.name, Addr: p.addr, Role: c.roleOf(p.id), Key: keyFingerprint(p.key), Muted: c.muted[p.id]})
+	}
+	return out
+}
+
+// resolveAddr fills in the host part of addr with the IP of the peer it was
+// received from, in case it is empty
+func resolveAddr(addr string, from peerID) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	remote, _, err := net.SplitHostPort(string(from))
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(remote, port)
 }
 
 func idOutHandler(c *Client, p ui.Packet) {
@@ -66,13 +179,45 @@ func idOutHandler(c *Client, p ui.Packet) {
 		c.logToUIf(":id needs a single, non-empty argument, received %v\n", args[1:])
 		return
 	}
-	c.broadcast(Packet{User: c.Name, Msg: p.Msg, Type: MsgTypeCmd}, "")
-	peersMu.Lock()
-	c.Name = args[1]
-	peersMu.Unlock()
-	go func() {
-		c.ToUI <- ui.Packet{Type: ui.PacketTypeCmd, Msg: p.Msg}
-	}()
+	peersMu.RLock()
+	taken := args[1] != c.Name && c.nameTaken(args[1], "")
+	peersMu.RUnlock()
+	if taken {
+		c.logToUIf("the name \"%s\" is taken\n", args[1])
+		return
+	}
+	c.rename(args[1])
+}
+
+func fingerprintOutHandler(c *Client, p ui.Packet) {
+	if c.TLS == nil && c.Identity == nil {
+		c.logToUIf("connections are not encrypted, and messages are not signed")
+		return
+	}
+	var cert string
+	if c.TLS != nil {
+		cert = certFingerprint(c.TLS.Certificates[0].Certificate[0])
+	}
+	var b strings.Builder
+	peersMu.RLock()
+	writeFingerprints(&b, c.Name+" (you)", cert, keyFingerprint(c.publicKey()))
+	for _, peer := range c.peers {
+		writeFingerprints(&b, peer.name, peer.fingerprint, keyFingerprint(peer.key))
+	}
+	peersMu.RUnlock()
+	c.logToUI(b.String())
+}
+
+// writeFingerprints lists the fingerprints of the certificate and identity
+// key of a user
+func writeFingerprints(b *strings.Builder, name, cert, key string) {
+	if cert == "" {
+		cert = "none"
+	}
+	if key == "" {
+		key = "none"
+	}
+	fmt.Fprintf(b, "%s\n  certificate:  %s\n  identity key: %s\n", name, cert, key)
 }
 
 func helpOutHandler(c *Client, p ui.Packet) {
@@ -80,18 +225,102 @@ func helpOutHandler(c *Client, p ui.Packet) {
 }
 
 func handleInbound(c *Client, p Packet, from peerID) {
+	// messages may reach a peer more than once, e.g. directly from the
+	// sender and relayed by the host
+	if c.seen.check(p.ID) {
+		return
+	}
+	c.observe(p.Clock)
 	switch p.Type {
 	case MsgTypePing:
+		peersMu.RLock()
+		c.transmit(Packet{Type: MsgTypePong, Seq: p.Seq}, from)
+		peersMu.RUnlock()
+		return
+	case MsgTypePong:
+		pongInHandler(c, p, from)
 		return
 	case MsgTypeChat:
-		c.ToUI <- ui.Packet{User: p.User, Msg: p.Msg}
-		c.broadcast(p, from)
+		if c.mutedSender(from) {
+			return
+		}
+		c.history.add(p)
+		peersMu.RLock()
+		joined := inRoom(c.rooms, p.Room)
+		peersMu.RUnlock()
+		if joined {
+			c.record(p)
+			if !c.ignoring(p) {
+				c.ToUI <- ui.Packet{User: p.User, Msg: p.Msg, Room: p.Room, Time: p.Time, ID: p.ID, Signature: c.verify(p)}
+			}
+			c.acknowledge(MsgTypeAck, p.User, p.ID)
+		}
+		// peers send chat messages to everyone they are connected to. The
+		// host forwards them as well, reaching peers which joined recently
+		// and aren't connected to everyone yet.
+		if c.host {
+			c.broadcast(p, from)
+		}
+		return
+	case MsgTypeMembers:
+		membersInHandler(c, p, from)
+		return
+	case MsgTypePrivate:
+		privateInHandler(c, p, from)
+		return
+	case MsgTypeAck, MsgTypeRead:
+		receiptInHandler(c, p, from)
+		return
+	case MsgTypeFileOffer:
+		fileOfferInHandler(c, p, from)
+		return
+	case MsgTypeFileAccept, MsgTypeFileReject:
+		fileAnswerInHandler(c, p, from)
+		return
+	case MsgTypeFileChunk:
+		fileChunkInHandler(c, p, from)
+		return
+	case MsgTypePresence:
+		presenceInHandler(c, p, from)
+		return
+	case MsgTypeWho:
+		whoInHandler(c, p, from)
+		return
+	case MsgTypeRoster:
+		rosterInHandler(c, p, from)
+		return
+	case MsgTypeName:
+		nameInHandler(c, p, from)
+		return
+	case MsgTypeKick:
+		kickInHandler(c, p, from)
+		return
+	case MsgTypeMute, MsgTypeUnmute:
+		muteInHandler(c, p, from)
+		return
+	case MsgTypeTyping:
+		typingInHandler(c, p, from)
+		return
+	case MsgTypeHistory:
+		// messages sent before this client joined, replayed by the host.
+		// They were signed as chat messages.
+		p.Type = MsgTypeChat
+		c.history.add(p)
+		c.record(p)
+		if !c.ignoring(p) {
+			c.ToUI <- ui.Packet{User: p.User, Msg: p.Msg, Room: p.Room, Type: ui.PacketTypeHistory, Time: p.Time, Signature: c.verify(p)}
+		}
 		return
 	case MsgTypeAdmin:
 		c.ToUI <- ui.Packet{User: p.User, Msg: p.Msg, Type: ui.PacketTypeAdmin}
 	case MsgTypeCmd:
 		if h, ok := checkInCmd(p.Msg); ok {
-			h(c, p, from)
+			peersMu.RLock()
+			allowed := c.allowed(from, h.role, strings.Fields(p.Msg)[0])
+			peersMu.RUnlock()
+			if allowed {
+				h.in(c, p, from)
+			}
 		} else {
 			c.logToUIf("invalid command '%s'. Run ':h' or ':help' to see available commands\n", p.Msg)
 		}
@@ -99,29 +328,61 @@ func handleInbound(c *Client, p Packet, from peerID) {
 	}
 }
 
-func checkInCmd(msg string) (InboundHandler, bool) {
+func checkInCmd(msg string) (MsgHandler, bool) {
 	if !strings.HasPrefix(msg, ":") {
-		return nil, false
+		return MsgHandler{}, false
 	}
 	args := strings.Split(msg, " ")
 	h, ok := MsgHandlers[args[0]]
-	return h.in, ok
+	return h, ok
 }
 
 func handleOutbound(c *Client, p ui.Packet) {
+	switch p.Type {
+	case ui.PacketTypeRead:
+		c.acknowledge(MsgTypeRead, p.User, p.ID)
+		return
+	case ui.PacketTypeIdle:
+		c.idle()
+		return
+	case ui.PacketTypeActive:
+		c.active()
+		return
+	case ui.PacketTypeTyping:
+		c.typing()
+		return
+	}
 	if strings.HasPrefix(p.Msg, ":") {
 		if h, ok := checkOutCmd(p.Msg); ok {
-			h(c, p)
+			peersMu.RLock()
+			role := c.roleOf(c.id)
+			peersMu.RUnlock()
+			if role < h.role {
+				c.logToUIf("%s needs the %s role", strings.Fields(p.Msg)[0], h.role)
+				return
+			}
+			h.out(c, p)
 		} else {
 			c.logToUIf("invalid command '%s'. Run ':h' or ':help' to see available commands\n", p.Msg)
 		}
 	} else {
-		c.broadcast(Packet{User: c.Name, Msg: p.Msg, Type: MsgTypeChat}, "")
+		if c.isMuted() {
+			return
+		}
+		peersMu.RLock()
+		room := c.activeRoom()
+		peersMu.RUnlock()
+		pkt := Packet{User: c.Name, Msg: p.Msg, Type: MsgTypeChat, Room: room}
+		c.stamp(&pkt)
+		c.sign(&pkt)
+		c.history.add(pkt)
+		c.record(pkt)
+		c.send(pkt)
 	}
 }
 
-func checkOutCmd(msg string) (OutboundHandler, bool) {
+func checkOutCmd(msg string) (MsgHandler, bool) {
 	args := strings.Split(msg, " ")
 	h, ok := MsgHandlers[args[0]]
-	return h.out, ok
+	return h, ok
 }
@@ -30,13 +30,7 @@ func TestCheckInCmd(t *testing.T) {
 }
 
 func TestHandleInbound(t *testing.T) {
-	tests := []struct {
-		name        string
-		from        peerID
-		in          Packet
-		uiPackets   []ui.Packet
-		peerPackets [][]Packet
-	}{
+	tests := []inboundTest{
 		{
 			"chat message from peer 0",
 			"0",
@@ -83,15 +77,103 @@ func TestHandleInbound(t *testing.T) {
 			Packet{User: "peer_0", Msg: ":id jon", Type: MsgTypeCmd},
 			[]ui.Packet{{User: "", Msg: "user \"peer_0\" changed their name to \"jon\"", Type: ui.PacketTypeAdmin}},
 			[][]Packet{
+				{hostMembers},
+				{hostMembers},
+			},
+		},
+	}
+
+	runInboundTests(t, true, tests)
+}
+
+func TestHandleInboundAsPeer(t *testing.T) {
+	tests := []inboundTest{
+		{
+			"chat message is not forwarded",
+			"0",
+			Packet{User: "peer_0", Msg: "test", ID: "a-1"},
+			[]ui.Packet{{User: "peer_0", Msg: "test", Type: ui.PacketTypeChat, ID: "a-1"}},
+			[][]Packet{
+				{{User: "testClient", Type: MsgTypeAck, To: "peer_0", Ref: "a-1"}},
 				{},
-				{Packet{Type: MsgTypeAdmin, Msg: "user \"peer_0\" changed their name to \"jon\""}},
 			},
 		},
 	}
 
+	runInboundTests(t, false, tests)
+}
+
+func TestHandleInboundDuplicates(t *testing.T) {
+	c := newTestClient(true, 2, &NullScanner{})
+	pkt := Packet{User: "peer_0", Msg: "test", ID: "a-1"}
+	handleInbound(&c, pkt, "0")
+	handleInbound(&c, pkt, "1")
+
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = compareUIPackets([]ui.Packet{{User: "peer_0", Msg: "test", ID: "a-1"}}, uiPackets); err != nil {
+		t.Errorf("UI packets diff failed: %v", err)
+	}
+	pkts, err := readFromPeer(&c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = compareNetPackets([]Packet{pkt}, pkts); err != nil {
+		t.Errorf("peer_1 diff failed: %v", err)
+	}
+}
+
+func TestHandleInboundDuplicatePrivate(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	pkt := Packet{User: "peer_0", Msg: "psst", Type: MsgTypePrivate, ID: "a-1", To: "testClient"}
+	handleInbound(&c, pkt, "0")
+	handleInbound(&c, pkt, "1")
+
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = compareUIPackets([]ui.Packet{{User: "peer_0", Msg: "psst", Type: ui.PacketTypePrivate, ID: "a-1"}}, uiPackets); err != nil {
+		t.Errorf("UI packets diff failed: %v", err)
+	}
+}
+
+func TestResolveAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		from peerID
+		out  string
+	}{
+		{":5000", "10.0.0.3:43210", "10.0.0.3:5000"},
+		{"10.0.0.4:5000", "10.0.0.3:43210", "10.0.0.4:5000"},
+		{":5000", "[fe80::1]:43210", "[fe80::1]:5000"},
+		{":5000", "0", ":5000"},
+	}
+	for _, tt := range tests {
+		if out := resolveAddr(tt.addr, tt.from); out != tt.out {
+			t.Errorf("resolveAddr(%q, %q): expected %q, got %q", tt.addr, tt.from, tt.out, out)
+		}
+	}
+}
+
+// member list sent by a test client acting as host, whose peers haven't
+// introduced themselves
+var hostMembers = Packet{Type: MsgTypeMembers, Peers: []PeerInfo{{ID: "testClientID", Name: "testClient", Addr: ":0", Role: RoleOwner}}}
+
+type inboundTest struct {
+	name        string
+	from        peerID
+	in          Packet
+	uiPackets   []ui.Packet
+	peerPackets [][]Packet
+}
+
+func runInboundTests(t *testing.T, host bool, tests []inboundTest) {
 	numPeers := 2
 	for _, tt := range tests {
-		c := newTestClient(true, numPeers, &NullScanner{})
+		c := newTestClient(host, numPeers, &NullScanner{})
 		t.Run(tt.name, func(t *testing.T) {
 			// check if test is setup properly
 			if len(tt.peerPackets) != numPeers {
@@ -121,7 +203,6 @@ func TestHandleInbound(t *testing.T) {
 			}
 		})
 	}
-
 }
 
 func compareUIPackets(expected []ui.Packet, got []ui.Packet) error {
@@ -0,0 +1,61 @@
+package lan
+
+import (
+	"fmt"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+// namesCapability is announced by peers accepting the name assigned by the
+// host when theirs is taken. Peers lacking it are rejected instead.
+const namesCapability = "names"
+
+// nameTaken returns whether name is used by this client, or by any peer
+// other than except. Callers must hold peersMu.
+func (c *Client) nameTaken(name string, except peerID) bool {
+	if name == c.Name {
+		return true
+	}
+	for pid, p := range c.peers {
+		if pid != except && p.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueName returns name, followed by the lowest number making it unique
+// if it is taken, e.g. "noone-2". Callers must hold peersMu.
+func (c *Client) uniqueName(name string, except peerID) string {
+	if !c.nameTaken(name, except) {
+		return name
+	}
+	for i := 2; ; i++ {
+		n := fmt.Sprintf("%s-%d", name, i)
+		if !c.nameTaken(n, except) {
+			return n
+		}
+	}
+}
+
+// rename changes the name of this client, telling peers and the UI about it
+func (c *Client) rename(name string) {
+	peersMu.Lock()
+	c.sendAll(Packet{User: c.Name, Msg: ":id " + name, Type: MsgTypeCmd}, "")
+	c.Name = name
+	c.peersChanged()
+	peersMu.Unlock()
+	go func() {
+		c.ToUI <- ui.Packet{Type: ui.PacketTypeCmd, Msg: ":id " + name}
+	}()
+}
+
+// nameInHandler takes the name assigned by the host, after the one asked
+// for turned out to be taken
+func nameInHandler(c *Client, p Packet, from peerID) {
+	if !c.fromHost(from) || p.Name == "" {
+		return
+	}
+	c.logToUIf("%s; you are \"%s\"", p.Msg, p.Name)
+	c.rename(p.Name)
+}
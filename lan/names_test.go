@@ -0,0 +1,157 @@
+package lan
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestHandshakeWithTakenName(t *testing.T) {
+	tests := []struct {
+		name  string
+		guest string
+		caps  []string
+		err   string
+		taken string // name the guest gets
+	}{
+		{"taken by host", "testClient", capabilities, "", "testClient-2"},
+		{"taken by peer", "peer_0", capabilities, "", "peer_0-2"},
+		{"legacy client", "peer_0", []string{"mesh"}, "connection rejected: the name \"peer_0\" is taken", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(caps []string) { capabilities = caps }(capabilities)
+			capabilities = tt.caps
+			host := newTestClient(true, 1, &NullScanner{})
+			guest := newTestClient(false, 0, &NullScanner{})
+			guest.Name = tt.guest
+			guest.id = "guestID"
+
+			conn, err := net.Dial("tcp", listen(t, &host))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_, _, err = guest.handshake(conn)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, func() bool {
+				peersMu.RLock()
+				defer peersMu.RUnlock()
+				return guest.Name == tt.taken && host.nameTaken(tt.taken, "")
+			})
+			uiPackets := receiveUI(t, &guest, 2)
+			expected := []ui.Packet{
+				{Type: ui.PacketTypeAdmin, Msg: "the name \"" + tt.guest + "\" is taken; you are \"" + tt.taken + "\""},
+				{Type: ui.PacketTypeCmd, Msg: ":id " + tt.taken},
+			}
+			if err = compareUIPackets(expected, uiPackets); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	c := newTestClient(true, 2, &NullScanner{})
+	c.peers["1"].name = "peer_0-2"
+	if name := c.uniqueName("peer_0", ""); name != "peer_0-3" {
+		t.Errorf("expected peer_0-3, got %s", name)
+	}
+	if name := c.uniqueName("peer_0", "0"); name != "peer_0" {
+		t.Errorf("expected peers to keep their own name, got %s", name)
+	}
+}
+
+func TestIdOutTaken(t *testing.T) {
+	c := newTestClient(false, 1, &NullScanner{})
+	handleOutbound(&c, ui.Packet{Msg: ":id peer_0"})
+	if c.Name != "testClient" {
+		t.Errorf("expected name to be kept, got %s", c.Name)
+	}
+	pkts, err := readFromPeer(&c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 0 {
+		t.Errorf("expected nothing to be sent, got %+v", pkts)
+	}
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = compareUIPackets([]ui.Packet{{Type: ui.PacketTypeAdmin, Msg: "the name \"peer_0\" is taken\n"}}, uiPackets); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIdInTaken(t *testing.T) {
+	tests := []inboundTest{
+		{
+			"host rejects taken name",
+			"1",
+			Packet{User: "peer_1", Msg: ":id peer_0", Type: MsgTypeCmd},
+			[]ui.Packet{},
+			[][]Packet{{}, {{User: "testClient", Type: MsgTypeName, Name: "peer_1", Msg: "the name \"peer_0\" is taken"}}},
+		},
+		{
+			"host rejects its own name",
+			"1",
+			Packet{User: "peer_1", Msg: ":id testClient", Type: MsgTypeCmd},
+			[]ui.Packet{},
+			[][]Packet{{}, {{User: "testClient", Type: MsgTypeName, Name: "peer_1", Msg: "the name \"testClient\" is taken"}}},
+		},
+	}
+	runInboundTests(t, true, tests)
+}
+
+func TestNameInHandler(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	c.peers["0"].host = true
+	// only the host assigns names
+	handleInbound(&c, Packet{Type: MsgTypeName, Name: "mallory", Msg: "the name \"x\" is taken"}, "1")
+	handleInbound(&c, Packet{Type: MsgTypeName, Name: "jon", Msg: "the name \"peer_1\" is taken"}, "0")
+	if c.Name != "jon" {
+		t.Errorf("expected name assigned by the host, got %s", c.Name)
+	}
+	pkts, err := readFromPeer(&c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = compareNetPackets([]Packet{{User: "testClient", Msg: ":id jon", Type: MsgTypeCmd}}, pkts); err != nil {
+		t.Error(err)
+	}
+	uiPackets := receiveUI(t, &c, 2)
+	expected := []ui.Packet{
+		{Type: ui.PacketTypeAdmin, Msg: "the name \"peer_1\" is taken; you are \"jon\""},
+		{Type: ui.PacketTypeCmd, Msg: ":id jon"},
+	}
+	if err = compareUIPackets(expected, uiPackets); err != nil {
+		t.Error(err)
+	}
+}
+
+// receiveUI waits for n UI packets, some of which may be sent from other
+// goroutines
+func receiveUI(t *testing.T, c *Client, n int) []ui.Packet {
+	t.Helper()
+	out := make([]ui.Packet, 0, n)
+	for len(out) < n {
+		select {
+		case p := <-c.ToUI:
+			out = append(out, p)
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d UI packets, got %+v", n, out)
+		}
+	}
+	return out
+}
@@ -0,0 +1,129 @@
+package lan
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+// DefaultMaxMissedPings is the number of pings in a row a peer may leave
+// unanswered before being disconnected, unless configured otherwise
+const DefaultMaxMissedPings = 3
+
+const pingInterval = 3 * time.Second
+
+// pongCapability is announced by peers answering pings. Older peers don't,
+// so they are never disconnected for missing them.
+const pongCapability = "pong"
+
+type sentPing struct {
+	time   time.Time
+	manual bool // whether it was sent by :ping, which shows the answer
+}
+
+// ping pings every peer periodically, so that connections which silently
+// died, e.g. when a laptop is suspended, are noticed
+func (c *Client) ping(ctx context.Context) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.pingAll()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pingAll pings every peer, disconnecting those which left too many pings
+// in a row unanswered
+func (c *Client) pingAll() {
+	var gone []string
+	peersMu.Lock()
+	for pid, peer := range c.peers {
+		if c.MaxMissedPings > 0 && len(peer.pings) >= c.MaxMissedPings {
+			gone = append(gone, fmt.Sprintf("'%s' missed %d pings, last seen %s ago; disconnecting", peer.name, len(peer.pings), time.Since(peer.lastSeen).Round(time.Second)))
+			go c.cleanPeer(pid)
+			continue
+		}
+		c.sendPing(pid, false)
+	}
+	peersMu.Unlock()
+	for _, msg := range gone {
+		c.logToUI(msg)
+	}
+}
+
+// sendPing sends a ping with a new sequence number to a peer. Callers must
+// hold peersMu for writing.
+func (c *Client) sendPing(pid peerID, manual bool) {
+	peer := c.peers[pid]
+	seq := atomic.AddUint64(&c.pingSeq, 1)
+	if hasCapability(peer.caps, pongCapability) {
+		if peer.pings == nil {
+			peer.pings = make(map[uint64]sentPing)
+		}
+		peer.pings[seq] = sentPing{time: time.Now(), manual: manual}
+	}
+	c.transmit(Packet{Type: MsgTypePing, Seq: seq}, pid)
+}
+
+func pongInHandler(c *Client, p Packet, from peerID) {
+	peersMu.Lock()
+	peer, ok := c.peers[from]
+	if !ok {
+		peersMu.Unlock()
+		return
+	}
+	sent, ok := peer.pings[p.Seq]
+	if !ok {
+		peersMu.Unlock()
+		return
+	}
+	peer.rtt = time.Since(sent.time)
+	// earlier pings were either lost or are answered late; either way, the
+	// peer is alive
+	for seq := range peer.pings {
+		if seq <= p.Seq {
+			delete(peer.pings, seq)
+		}
+	}
+	name, rtt := peer.name, peer.rtt
+	peersMu.Unlock()
+	if sent.manual {
+		c.logToUIf("pong from \"%s\": %v", name, rtt.Round(time.Microsecond))
+	}
+}
+
+// pingOutHandler pings a user, showing the round-trip time once they answer
+func pingOutHandler(c *Client, p ui.Packet) {
+	args := strings.Split(p.Msg, " ")
+	if len(args) != 2 || args[1] == "" {
+		c.logToUIf(":ping needs a single user name, received %v\n", args[1:])
+		return
+	}
+	var found, legacy bool
+	peersMu.Lock()
+	for pid, peer := range c.peers {
+		if peer.name != args[1] {
+			continue
+		}
+		found = true
+		if !hasCapability(peer.caps, pongCapability) {
+			legacy = true
+			continue
+		}
+		c.sendPing(pid, true)
+	}
+	peersMu.Unlock()
+	if !found {
+		c.logToUIf("no user named \"%s\"\n", args[1])
+	} else if legacy {
+		c.logToUIf("\"%s\" runs an older lanchat version, which doesn't answer pings\n", args[1])
+	}
+}
@@ -0,0 +1,123 @@
+package lan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestPingInbound(t *testing.T) {
+	tests := []inboundTest{
+		{
+			"ping is answered",
+			"1",
+			Packet{Type: MsgTypePing, Seq: 7},
+			[]ui.Packet{},
+			[][]Packet{{}, {{Type: MsgTypePong, Seq: 7}}},
+		},
+		{
+			"unexpected pong is ignored",
+			"0",
+			Packet{Type: MsgTypePong, Seq: 7},
+			[]ui.Packet{},
+			[][]Packet{{}, {}},
+		},
+	}
+	runInboundTests(t, false, tests)
+}
+
+func TestPong(t *testing.T) {
+	c := newTestClient(false, 1, &NullScanner{})
+	peer := c.peers["0"]
+	peer.caps = []string{pongCapability}
+	peersMu.Lock()
+	c.sendPing("0", false)
+	c.sendPing("0", true)
+	peersMu.Unlock()
+
+	pkts, err := readFromPeer(&c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 2 || pkts[0].Type != MsgTypePing || pkts[1].Seq != pkts[0].Seq+1 {
+		t.Fatalf("expected pings with increasing sequence numbers, got %+v", pkts)
+	}
+	// answering the last ping accounts for earlier ones as well
+	handleInbound(&c, Packet{Type: MsgTypePong, Seq: pkts[1].Seq}, "0")
+	if len(peer.pings) != 0 {
+		t.Errorf("expected no pings left unanswered, got %+v", peer.pings)
+	}
+	if peer.rtt <= 0 {
+		t.Errorf("expected round-trip time to be measured, got %v", peer.rtt)
+	}
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uiPackets) != 1 || uiPackets[0].Type != ui.PacketTypeAdmin {
+		t.Errorf("expected answer to :ping to be shown, got %+v", uiPackets)
+	}
+}
+
+func TestPingAllEvictsUnresponsivePeers(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	c.MaxMissedPings = 2
+	c.peers["0"].caps = []string{pongCapability}
+	c.peers["0"].lastSeen = time.Now()
+	// peer_1 runs an older version, which never answers
+	c.pingAll()
+	c.pingAll()
+	if len(c.peers["0"].pings) != 2 {
+		t.Fatalf("expected 2 pings left unanswered, got %+v", c.peers["0"].pings)
+	}
+	c.pingAll()
+
+	waitFor(t, func() bool {
+		peersMu.RLock()
+		defer peersMu.RUnlock()
+		_, ok := c.peers["0"]
+		return !ok
+	})
+	peersMu.RLock()
+	_, ok := c.peers["1"]
+	peersMu.RUnlock()
+	if !ok {
+		t.Errorf("expected peer without pong capability to be kept")
+	}
+}
+
+func TestPingOutHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		caps []string
+		out  []ui.Packet
+	}{
+		{"pong capability", ":ping peer_0", []string{pongCapability}, []ui.Packet{}},
+		{"older peer", ":ping peer_0", nil, []ui.Packet{{Msg: "\"peer_0\" runs an older lanchat version, which doesn't answer pings\n", Type: ui.PacketTypeAdmin}}},
+		{"unknown user", ":ping jon", nil, []ui.Packet{{Msg: "no user named \"jon\"\n", Type: ui.PacketTypeAdmin}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(false, 1, &NullScanner{})
+			c.peers["0"].caps = tt.caps
+			handleOutbound(&c, ui.Packet{Msg: tt.msg})
+
+			uiPackets, err := readUI(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = compareUIPackets(tt.out, uiPackets); err != nil {
+				t.Error(err)
+			}
+			pkts, err := readFromPeer(&c, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pkts) != 1-len(tt.out) {
+				t.Errorf("expected %d pings, got %+v", 1-len(tt.out), pkts)
+			}
+		})
+	}
+}
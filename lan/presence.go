@@ -0,0 +1,111 @@
+package lan
+
+import (
+	"fmt"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+// statuses a user may be in
+const (
+	PresenceOnline = "online"
+	PresenceAway   = "away"
+	PresenceBusy   = "busy"
+)
+
+// reason given when going away automatically, after the user stops typing
+const idleReason = "idle"
+
+// Presence tells whether a user is around. It is sent to peers with the
+// Hello of every connection, and with MsgTypePresence whenever it changes.
+type Presence struct {
+	Status string // one of the Presence constants; peers predating presence leave it empty, and count as online
+	Reason string
+}
+
+func (p Presence) String() string {
+	if p.Status == "" {
+		return PresenceOnline
+	}
+	if p.Reason == "" {
+		return p.Status
+	}
+	return fmt.Sprintf("%s (%s)", p.Status, p.Reason)
+}
+
+// setPresence changes the presence of this client, and tells peers about
+// it. auto marks presence set when the user stops typing, which is reset
+// once they type again.
+func (c *Client) setPresence(pr Presence, auto bool) {
+	peersMu.Lock()
+	if c.presence == pr {
+		peersMu.Unlock()
+		return
+	}
+	c.presence = pr
+	c.autoAway = auto
+	c.peersChanged()
+	c.sendAll(Packet{User: c.Name, Type: MsgTypePresence, Presence: &pr}, "")
+	peersMu.Unlock()
+	c.ToUI <- ui.Packet{Type: ui.PacketTypeCmd, Msg: ":presence " + pr.Status}
+	if pr.Status == PresenceOnline {
+		c.logToUIf("you are back")
+	} else {
+		c.logToUIf("you are now %s", pr)
+	}
+}
+
+func awayOutHandler(c *Client, p ui.Packet) {
+	c.setPresence(Presence{Status: PresenceAway, Reason: commandArg(p.Msg)}, false)
+}
+
+func busyOutHandler(c *Client, p ui.Packet) {
+	c.setPresence(Presence{Status: PresenceBusy, Reason: commandArg(p.Msg)}, false)
+}
+
+func backOutHandler(c *Client, p ui.Packet) {
+	c.setPresence(Presence{Status: PresenceOnline}, false)
+}
+
+// idle marks the user as away once they stop typing, unless they set their
+// presence themselves
+func (c *Client) idle() {
+	peersMu.RLock()
+	status := c.presence.Status
+	peersMu.RUnlock()
+	if status != PresenceAway && status != PresenceBusy {
+		c.setPresence(Presence{Status: PresenceAway, Reason: idleReason}, true)
+	}
+}
+
+// active marks the user as back once they type again, if they were marked
+// as away for being idle
+func (c *Client) active() {
+	peersMu.RLock()
+	auto := c.autoAway
+	peersMu.RUnlock()
+	if auto {
+		c.setPresence(Presence{Status: PresenceOnline}, false)
+	}
+}
+
+func presenceInHandler(c *Client, p Packet, from peerID) {
+	if p.Presence == nil {
+		return
+	}
+	peersMu.Lock()
+	peer, ok := c.peers[from]
+	if !ok || peer.presence == *p.Presence {
+		peersMu.Unlock()
+		return
+	}
+	peer.presence = *p.Presence
+	c.peersChanged()
+	name := peer.name
+	peersMu.Unlock()
+	if p.Presence.Status == PresenceOnline {
+		c.logToUIf("\"%s\" is back", name)
+	} else {
+		c.logToUIf("\"%s\" is %s", name, p.Presence)
+	}
+}
@@ -0,0 +1,87 @@
+package lan
+
+import (
+	"testing"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestPresenceOutHandlers(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      string
+		presence Presence
+		out      string
+	}{
+		{"away with reason", ":away lunch", Presence{Status: PresenceAway, Reason: "lunch"}, "you are now away (lunch)"},
+		{"busy", ":busy", Presence{Status: PresenceBusy}, "you are now busy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(false, 1, &NullScanner{})
+			handleOutbound(&c, ui.Packet{Msg: tt.msg})
+
+			if c.presence != tt.presence {
+				t.Errorf("expected presence %+v, got %+v", tt.presence, c.presence)
+			}
+			pkts, err := readFromPeer(&c, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pkts) != 1 || pkts[0].Type != MsgTypePresence || *pkts[0].Presence != tt.presence {
+				t.Errorf("expected presence to be sent to peers, got %+v", pkts)
+			}
+			uiPackets, err := readUI(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []ui.Packet{
+				{Type: ui.PacketTypeCmd, Msg: ":presence " + tt.presence.Status},
+				{Type: ui.PacketTypeAdmin, Msg: tt.out},
+			}
+			if err = compareUIPackets(expected, uiPackets); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestAutoAway(t *testing.T) {
+	c := newTestClient(false, 0, &NullScanner{})
+	handleOutbound(&c, ui.Packet{Type: ui.PacketTypeIdle})
+	if c.presence != (Presence{Status: PresenceAway, Reason: idleReason}) || !c.autoAway {
+		t.Fatalf("expected idle user to be away, got %+v", c.presence)
+	}
+	handleOutbound(&c, ui.Packet{Type: ui.PacketTypeActive})
+	if c.presence.Status != PresenceOnline {
+		t.Errorf("expected user typing again to be back, got %+v", c.presence)
+	}
+
+	// users who set their presence themselves keep it
+	handleOutbound(&c, ui.Packet{Msg: ":busy"})
+	handleOutbound(&c, ui.Packet{Type: ui.PacketTypeIdle})
+	handleOutbound(&c, ui.Packet{Type: ui.PacketTypeActive})
+	if c.presence.Status != PresenceBusy {
+		t.Errorf("expected user to stay busy, got %+v", c.presence)
+	}
+}
+
+func TestPresenceInbound(t *testing.T) {
+	tests := []inboundTest{
+		{
+			"peer goes away",
+			"0",
+			Packet{User: "peer_0", Type: MsgTypePresence, Presence: &Presence{Status: PresenceAway, Reason: "lunch"}},
+			[]ui.Packet{{Msg: "\"peer_0\" is away (lunch)", Type: ui.PacketTypeAdmin}},
+			[][]Packet{{}, {}},
+		},
+		{
+			"peer is back",
+			"1",
+			Packet{User: "peer_1", Type: MsgTypePresence, Presence: &Presence{Status: PresenceOnline}},
+			[]ui.Packet{{Msg: "\"peer_1\" is back", Type: ui.PacketTypeAdmin}},
+			[][]Packet{{}, {}},
+		},
+	}
+	runInboundTests(t, false, tests)
+}
@@ -0,0 +1,111 @@
+package lan
+
+import (
+	"strings"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+// msgOutHandler sends a private message to a single user
+func msgOutHandler(c *Client, p ui.Packet) {
+	args := strings.SplitN(p.Msg, " ", 3)
+	if len(args) != 3 || args[1] == "" || strings.TrimSpace(args[2]) == "" {
+		c.logToUIf(":msg needs a user name and a message, received %v\n", args[1:])
+		return
+	}
+	c.sendPrivate(args[1], args[2])
+}
+
+// replyOutHandler sends a private message to whoever sent the last one
+// received
+func replyOutHandler(c *Client, p ui.Packet) {
+	args := strings.SplitN(p.Msg, " ", 2)
+	if len(args) != 2 || strings.TrimSpace(args[1]) == "" {
+		c.logToUIf(":reply needs a message\n")
+		return
+	}
+	peersMu.RLock()
+	to := c.lastPrivate
+	peersMu.RUnlock()
+	if to == "" {
+		c.logToUIf("no private message to reply to\n")
+		return
+	}
+	c.sendPrivate(to, args[1])
+}
+
+// sendPrivate sends a private message to the user named to
+func (c *Client) sendPrivate(to, msg string) {
+	if c.isMuted() {
+		return
+	}
+	pkt := Packet{User: c.Name, Msg: msg, Type: MsgTypePrivate, To: to}
+	c.stamp(&pkt)
+	c.sign(&pkt)
+	c.send(pkt)
+}
+
+// deliver sends pkt directly to the peers named pkt.To. If there is no
+// connection to them yet, the host is asked to forward it. It returns false
+// if there is neither.
+func (c *Client) deliver(pkt Packet) bool {
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	if c.sendTo(pkt, pkt.To, "") {
+		return true
+	}
+	for pid, peer := range c.peers {
+		if peer.host {
+			c.transmit(pkt, pid)
+			return true
+		}
+	}
+	return false
+}
+
+// sendTo sends pkt to all peers with the given name, except one, returning
+// whether there were any. Callers must hold peersMu.
+func (c *Client) sendTo(pkt Packet, name string, except peerID) bool {
+	sent := false
+	for pid, peer := range c.peers {
+		if peer.name == name && pid != except {
+			c.transmit(pkt, pid)
+			sent = true
+		}
+	}
+	return sent
+}
+
+// forward returns whether p is addressed to another user. Peers only
+// receive those when they are the host, and the sender isn't connected to
+// the recipient, so the host forwards them. Callers must hold peersMu.
+func (c *Client) forward(p Packet, from peerID) bool {
+	if p.To == "" || p.To == c.Name {
+		return false
+	}
+	if c.host {
+		c.sendTo(p, p.To, from)
+	}
+	return true
+}
+
+func privateInHandler(c *Client, p Packet, from peerID) {
+	if c.mutedSender(from) {
+		return
+	}
+	ignored := c.ignoring(p)
+	peersMu.Lock()
+	if c.forward(p, from) {
+		peersMu.Unlock()
+		return
+	}
+	if !ignored {
+		c.lastPrivate = p.User
+	}
+	peersMu.Unlock()
+	// ignored users aren't told, so they get receipts as usual
+	if !ignored {
+		c.ToUI <- ui.Packet{User: p.User, Msg: p.Msg, Type: ui.PacketTypePrivate, Time: p.Time, ID: p.ID, Signature: c.verify(p)}
+	}
+	c.acknowledge(MsgTypeAck, p.User, p.ID)
+}
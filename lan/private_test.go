@@ -0,0 +1,105 @@
+package lan
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestMsgOutHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		msg       string
+		hostPeer  int
+		received  []int
+		uiPackets []ui.Packet
+	}{
+		{"connected recipient", ":msg peer_1 hi there", -1, []int{1}, []ui.Packet{}},
+		{"unknown recipient, forwarded by host", ":msg jon hi there", 0, []int{0}, []ui.Packet{}},
+		{
+			"unknown recipient, without host",
+			":msg jon hi there",
+			-1,
+			[]int{},
+			[]ui.Packet{{Msg: "no user named \"jon\"\n", Type: ui.PacketTypeAdmin}},
+		},
+		{
+			"missing message",
+			":msg peer_1",
+			-1,
+			[]int{},
+			[]ui.Packet{{Msg: ":msg needs a user name and a message, received [peer_1]\n", Type: ui.PacketTypeAdmin}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(false, 2, &NullScanner{})
+			if tt.hostPeer >= 0 {
+				c.peers[peerID(strconv.Itoa(tt.hostPeer))].host = true
+			}
+			handleOutbound(&c, ui.Packet{Msg: tt.msg})
+
+			uiPackets, err := readUI(&c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = compareUIPackets(tt.uiPackets, uiPackets); err != nil {
+				t.Errorf("UI packets diff failed: %v", err)
+			}
+			for i := 0; i < 2; i++ {
+				pkts, err := readFromPeer(&c, i)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected := 0
+				for _, r := range tt.received {
+					if r == i {
+						expected = 1
+					}
+				}
+				if len(pkts) != expected {
+					t.Fatalf("expected peer_%d to receive %d packets, got %+v", i, expected, pkts)
+				}
+				if expected == 1 && (pkts[0].Type != MsgTypePrivate || pkts[0].Msg != "hi there") {
+					t.Errorf("expected private message, got %+v", pkts[0])
+				}
+			}
+		})
+	}
+}
+
+func TestPrivateInbound(t *testing.T) {
+	tests := []inboundTest{
+		{
+			"private message to self",
+			"0",
+			Packet{User: "peer_0", Msg: "psst", Type: MsgTypePrivate, To: "testClient", ID: "a-1"},
+			[]ui.Packet{{User: "peer_0", Msg: "psst", Type: ui.PacketTypePrivate, ID: "a-1"}},
+			[][]Packet{{{User: "testClient", Type: MsgTypeAck, To: "peer_0", Ref: "a-1"}}, {}},
+		},
+		{
+			"private message forwarded by host",
+			"0",
+			Packet{User: "peer_0", Msg: "psst", Type: MsgTypePrivate, To: "peer_1", ID: "a-1"},
+			[]ui.Packet{},
+			[][]Packet{{}, {{User: "peer_0", Msg: "psst", Type: MsgTypePrivate, To: "peer_1", ID: "a-1"}}},
+		},
+	}
+	runInboundTests(t, true, tests)
+}
+
+func TestReplyOutHandler(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	handleInbound(&c, Packet{User: "peer_1", Msg: "psst", Type: MsgTypePrivate, To: "testClient", ID: "a-1"}, "1")
+	handleOutbound(&c, ui.Packet{Msg: ":reply got it"})
+
+	pkts, err := readFromPeer(&c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first packet acknowledges the message replied to
+	if len(pkts) != 2 || pkts[1].To != "peer_1" || pkts[1].Msg != "got it" {
+		t.Errorf("expected reply to peer_1, got %+v", pkts)
+	}
+}
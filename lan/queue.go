@@ -0,0 +1,84 @@
+package lan
+
+import "github.com/MarcPer/lanchat/ui"
+
+// offline returns whether this client can't reach the chat, e.g. while
+// looking for a new host. Callers must hold peersMu.
+func (c *Client) offline() bool {
+	return !c.online || (!c.host && len(c.peers) == 0)
+}
+
+// send transmits a chat or private message stamped by this client, and
+// tracks its receipts. While offline, the message is queued instead, and
+// sent by flush once connected to a host again. Chat messages are shown to
+// the user along with their status.
+func (c *Client) send(pkt Packet) {
+	peersMu.Lock()
+	if c.offline() {
+		c.queue = append(c.queue, pkt)
+		peersMu.Unlock()
+		c.showSent(pkt, ui.StatusQueued)
+		return
+	}
+	to := c.recipients(pkt)
+	peersMu.Unlock()
+	c.receipts.track(pkt, to)
+	c.showSent(pkt, ui.StatusPending)
+	c.dispatch(pkt)
+}
+
+// flush sends the messages queued while offline. Peers which received some
+// of them already, e.g. from the history replayed by a new host, discard
+// them as duplicates.
+func (c *Client) flush() {
+	peersMu.Lock()
+	queue := c.queue
+	c.queue = nil
+	peersMu.Unlock()
+	if len(queue) == 0 {
+		return
+	}
+	c.logToUIf("sending %d queued messages", len(queue))
+	for _, pkt := range queue {
+		peersMu.RLock()
+		to := c.recipients(pkt)
+		peersMu.RUnlock()
+		c.receipts.track(pkt, to)
+		if pkt.Type == MsgTypeChat {
+			c.ToUI <- ui.Packet{Type: ui.PacketTypeStatus, ID: pkt.ID, Status: ui.StatusPending}
+		}
+		c.dispatch(pkt)
+	}
+}
+
+func (c *Client) showSent(pkt Packet, status ui.Status) {
+	if pkt.Type != MsgTypeChat {
+		return
+	}
+	c.ToUI <- ui.Packet{User: pkt.User, Msg: pkt.Msg, Room: pkt.Room, Time: pkt.Time, ID: pkt.ID, Status: status, Type: ui.PacketTypeSent}
+}
+
+func (c *Client) dispatch(pkt Packet) {
+	if pkt.Type == MsgTypePrivate {
+		if !c.deliver(pkt) {
+			c.logToUIf("no user named \"%s\"\n", pkt.To)
+		}
+		return
+	}
+	c.broadcast(pkt, "")
+}
+
+// recipients lists the names of the peers a message is sent to. Callers
+// must hold peersMu.
+func (c *Client) recipients(pkt Packet) []string {
+	if pkt.Type == MsgTypePrivate {
+		return []string{pkt.To}
+	}
+	var to []string
+	for _, peer := range c.peers {
+		if inRoom(peer.rooms, pkt.Room) {
+			to = append(to, peer.name)
+		}
+	}
+	return to
+}
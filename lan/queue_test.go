@@ -0,0 +1,79 @@
+package lan
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestQueueWhileOffline(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	c.online = false
+	handleOutbound(&c, ui.Packet{Msg: "anyone there?"})
+	handleOutbound(&c, ui.Packet{Msg: ":msg peer_1 psst"})
+
+	for i := 0; i < 2; i++ {
+		pkts, err := readFromPeer(&c, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pkts) != 0 {
+			t.Fatalf("expected nothing to be sent while offline, got %+v", pkts)
+		}
+	}
+
+	c.online = true
+	c.flush()
+
+	pkts, err := readFromPeer(&c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 2 || pkts[0].ID != "testClientID-1" || pkts[1].Type != MsgTypePrivate || pkts[1].ID != "testClientID-2" {
+		t.Errorf("expected queued messages to be sent in order, got %+v", pkts)
+	}
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uiPackets) != 3 {
+		t.Fatalf("expected 3 UI packets, got %+v", uiPackets)
+	}
+	if uiPackets[0].Type != ui.PacketTypeSent || uiPackets[0].Status != ui.StatusQueued {
+		t.Errorf("expected message to be shown as queued, got %+v", uiPackets[0])
+	}
+	if !reflect.DeepEqual(uiPackets[1], ui.Packet{Msg: "sending 2 queued messages", Type: ui.PacketTypeAdmin}) {
+		t.Errorf("expected queued messages to be announced, got %+v", uiPackets[1])
+	}
+	if !reflect.DeepEqual(uiPackets[2], ui.Packet{Type: ui.PacketTypeStatus, ID: "testClientID-1", Status: ui.StatusPending}) {
+		t.Errorf("expected message to be pending once sent, got %+v", uiPackets[2])
+	}
+	if len(c.queue) != 0 {
+		t.Errorf("expected queue to be empty after flushing, got %+v", c.queue)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	tests := []struct {
+		name     string
+		online   bool
+		host     bool
+		numPeers int
+		offline  bool
+	}{
+		{"looking for a host", false, false, 1, true},
+		{"connected to peers", true, false, 1, false},
+		{"host lost, without other peers", true, false, 0, true},
+		{"hosting alone", true, true, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(tt.host, tt.numPeers, &NullScanner{})
+			c.online = tt.online
+			if got := c.offline(); got != tt.offline {
+				t.Errorf("expected offline=%v, got %v", tt.offline, got)
+			}
+		})
+	}
+}
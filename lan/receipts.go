@@ -0,0 +1,162 @@
+package lan
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+// receiptsSize is the number of sent messages whose receipts are tracked
+const receiptsSize = 256
+
+// receipt tracks which recipients received and read a message sent by this
+// client
+type receipt struct {
+	id    string
+	msg   string
+	time  time.Time
+	users map[string]ui.Status // status of the message for each recipient, by name
+}
+
+// status returns the status of the message as a whole, which is that of
+// the recipient lagging behind the most
+func (r *receipt) status() ui.Status {
+	if len(r.users) == 0 {
+		return ui.StatusPending
+	}
+	s := ui.StatusRead
+	for _, us := range r.users {
+		if us < s {
+			s = us
+		}
+	}
+	return s
+}
+
+// receipts keeps the most recent messages sent by this client, along with
+// the acknowledgements received for them
+type receipts struct {
+	mu   sync.Mutex
+	sent []*receipt // oldest first
+}
+
+// track starts tracking the receipts of a message sent to the given users
+func (r *receipts) track(p Packet, to []string) {
+	users := make(map[string]ui.Status, len(to))
+	for _, name := range to {
+		users[name] = ui.StatusPending
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, &receipt{id: p.ID, msg: p.Msg, time: p.Time, users: users})
+	if len(r.sent) > receiptsSize {
+		r.sent = r.sent[1:]
+	}
+}
+
+// update records the status of a message for one of its recipients. It
+// returns the status of the message as a whole, and whether it changed.
+// Recipients which were not expected, e.g. because they joined after the
+// message was sent, are added to it.
+func (r *receipts) update(id, user string, s ui.Status) (ui.Status, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rc := range r.sent {
+		if rc.id != id {
+			continue
+		}
+		if cur, ok := rc.users[user]; ok && cur >= s {
+			return rc.status(), false
+		}
+		before := rc.status()
+		rc.users[user] = s
+		after := rc.status()
+		return after, after != before
+	}
+	return ui.StatusPending, false
+}
+
+// find returns a copy of the receipt of the message with the given ID or,
+// failing that, of the most recent message containing query. An empty query
+// matches the last message sent.
+func (r *receipts) find(query string) *receipt {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var found *receipt
+	for i := len(r.sent) - 1; i >= 0 && found == nil; i-- {
+		if r.sent[i].id == query {
+			found = r.sent[i]
+		}
+	}
+	for i := len(r.sent) - 1; i >= 0 && found == nil; i-- {
+		if strings.Contains(r.sent[i].msg, query) {
+			found = r.sent[i]
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	cp := *found
+	cp.users = make(map[string]ui.Status, len(found.users))
+	for name, s := range found.users {
+		cp.users[name] = s
+	}
+	return &cp
+}
+
+// acknowledge tells the sender of a message that it was received or, with
+// MsgTypeRead, seen by the user
+func (c *Client) acknowledge(typ int, user, id string) {
+	if id == "" {
+		return
+	}
+	c.deliver(Packet{User: c.Name, Type: typ, To: user, Ref: id})
+}
+
+func receiptInHandler(c *Client, p Packet, from peerID) {
+	peersMu.RLock()
+	if c.forward(p, from) {
+		peersMu.RUnlock()
+		return
+	}
+	peersMu.RUnlock()
+	s := ui.StatusDelivered
+	if p.Type == MsgTypeRead {
+		s = ui.StatusRead
+	}
+	if status, changed := c.receipts.update(p.Ref, p.User, s); changed {
+		c.ToUI <- ui.Packet{Type: ui.PacketTypeStatus, ID: p.Ref, Status: status}
+	}
+}
+
+// receiptsOutHandler lists who received and read a message sent by this
+// client
+func receiptsOutHandler(c *Client, p ui.Packet) {
+	var query string
+	if args := strings.SplitN(p.Msg, " ", 2); len(args) == 2 {
+		query = strings.TrimSpace(args[1])
+	}
+	r := c.receipts.find(query)
+	if r == nil {
+		c.logToUIf("no message sent matching \"%s\"\n", query)
+		return
+	}
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("\"%s\", sent at %s: %s\n", r.msg, r.time.Local().Format("15:04"), r.status()))
+	names := make([]string, 0, len(r.users))
+	for name := range r.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString(fmt.Sprintf("%-16s\t%s\n", name, r.users[name]))
+	}
+	if len(names) == 0 {
+		b.WriteString("nobody was connected to receive it\n")
+	}
+	c.logToUI(b.String())
+}
@@ -0,0 +1,89 @@
+package lan
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestReceipts(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	handleOutbound(&c, ui.Packet{Msg: "lunch?"})
+	handleInbound(&c, Packet{User: "peer_0", Type: MsgTypeAck, To: "testClient", Ref: "testClientID-1"}, "0")
+	handleInbound(&c, Packet{User: "peer_1", Type: MsgTypeAck, To: "testClient", Ref: "testClientID-1"}, "1")
+	// acknowledging twice doesn't change anything
+	handleInbound(&c, Packet{User: "peer_1", Type: MsgTypeAck, To: "testClient", Ref: "testClientID-1"}, "1")
+	handleInbound(&c, Packet{User: "peer_0", Type: MsgTypeRead, To: "testClient", Ref: "testClientID-1"}, "0")
+	handleOutbound(&c, ui.Packet{Msg: ":receipts lunch"})
+
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uiPackets) != 3 {
+		t.Fatalf("expected 3 UI packets, got %+v", uiPackets)
+	}
+	sent := uiPackets[0]
+	if sent.Type != ui.PacketTypeSent || sent.ID != "testClientID-1" || sent.Status != ui.StatusPending {
+		t.Errorf("expected sent message to be pending, got %+v", sent)
+	}
+	// peer_1 hasn't read the message yet, so it is only delivered
+	if !reflect.DeepEqual(uiPackets[1], ui.Packet{Type: ui.PacketTypeStatus, ID: "testClientID-1", Status: ui.StatusDelivered}) {
+		t.Errorf("expected message to be delivered, got %+v", uiPackets[1])
+	}
+	for _, want := range []string{"delivered\n", "peer_0          \tread", "peer_1          \tdelivered"} {
+		if !strings.Contains(uiPackets[2].Msg, want) {
+			t.Errorf("expected receipts to contain %q, got %q", want, uiPackets[2].Msg)
+		}
+	}
+}
+
+func TestReceiptsOutHandlerWithoutMessages(t *testing.T) {
+	c := newTestClient(false, 0, &NullScanner{})
+	handleOutbound(&c, ui.Packet{Msg: ":receipts lunch"})
+
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ui.Packet{{Msg: "no message sent matching \"lunch\"\n", Type: ui.PacketTypeAdmin}}
+	if err = compareUIPackets(expected, uiPackets); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadReceipt(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	handleOutbound(&c, ui.Packet{Type: ui.PacketTypeRead, User: "peer_1", ID: "a-1"})
+
+	pkts, err := readFromPeer(&c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Packet{{User: "testClient", Type: MsgTypeRead, To: "peer_1", Ref: "a-1"}}
+	if err = compareNetPackets(expected, pkts); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReceiptsInbound(t *testing.T) {
+	tests := []inboundTest{
+		{
+			"receipt forwarded by host",
+			"0",
+			Packet{User: "peer_0", Type: MsgTypeAck, To: "peer_1", Ref: "a-1"},
+			[]ui.Packet{},
+			[][]Packet{{}, {{User: "peer_0", Type: MsgTypeAck, To: "peer_1", Ref: "a-1"}}},
+		},
+		{
+			"receipt for unknown message",
+			"0",
+			Packet{User: "peer_0", Type: MsgTypeAck, To: "testClient", Ref: "a-1"},
+			[]ui.Packet{},
+			[][]Packet{{}, {}},
+		},
+	}
+	runInboundTests(t, true, tests)
+}
@@ -0,0 +1,213 @@
+package lan
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+// Role tells which commands a user may run; see MsgHandler
+type Role int
+
+const (
+	RoleMember   Role = iota // everyone
+	RoleOperator             // granted with :op, allowed to moderate the chat
+	RoleOwner                // the host
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleOwner:
+		return "owner"
+	case RoleOperator:
+		return "operator"
+	default:
+		return "member"
+	}
+}
+
+// roleOf returns the role of the member with the given node ID. The host
+// owns the chat, and operators are named by the host, which distributes
+// them with the member list. Operators are known by their identity key,
+// which, unlike node IDs and names, no one else can present. Callers must
+// hold peersMu.
+func (c *Client) roleOf(id string) Role {
+	if id == c.id {
+		if c.host {
+			return RoleOwner
+		}
+		return c.roleOfKey(c.publicKey())
+	}
+	for _, p := range c.peers {
+		if p.id == id {
+			if p.host {
+				return RoleOwner
+			}
+			return c.roleOfKey(p.key)
+		}
+	}
+	return RoleMember
+}
+
+// roleOfKey returns the role named by the host for the user with the given
+// identity key. Callers must hold peersMu.
+func (c *Client) roleOfKey(key []byte) Role {
+	if len(key) == 0 {
+		return RoleMember
+	}
+	return c.roles[keyFingerprint(key)]
+}
+
+// dropRole forgets the role of a peer which disconnected, unless it is still
+// connected over another link; it has to be named again if it comes back.
+// Callers must hold peersMu.
+func (c *Client) dropRole(gone *peer) {
+	if len(gone.key) == 0 {
+		return
+	}
+	for _, p := range c.peers {
+		if bytes.Equal(p.key, gone.key) {
+			return
+		}
+	}
+	delete(c.roles, keyFingerprint(gone.key))
+}
+
+// owns returns whether the user with the given name owns the chat, and so
+// can't be moderated. Callers must hold peersMu.
+func (c *Client) owns(name string) bool {
+	if name == c.Name {
+		return c.roleOf(c.id) == RoleOwner
+	}
+	for _, p := range c.peers {
+		if p.name == name && c.roleOf(p.id) == RoleOwner {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed returns whether the user on the other end of the given connection
+// may run commands needing role. If not, they are told why. Callers must
+// hold peersMu.
+func (c *Client) allowed(from peerID, role Role, cmd string) bool {
+	peer, ok := c.peers[from]
+	if !ok {
+		return false
+	}
+	if c.roleOf(peer.id) >= role {
+		return true
+	}
+	c.transmit(Packet{User: c.Name, Type: MsgTypeAdmin, Msg: fmt.Sprintf("%s needs the %s role", cmd, role)}, from)
+	return false
+}
+
+// viaHost returns an OutboundHandler running action, which only takes
+// effect when run by the host. Other users allowed to run it ask the host
+// to do so on their behalf.
+func viaHost(action func(c *Client, by, cmd string) error) OutboundHandler {
+	return func(c *Client, p ui.Packet) {
+		peersMu.RLock()
+		if c.host {
+			peersMu.RUnlock()
+			if err := action(c, c.Name, p.Msg); err != nil {
+				c.logToUIf("%v", err)
+			}
+			return
+		}
+		for pid, peer := range c.peers {
+			if peer.host {
+				c.transmit(Packet{User: c.Name, Type: MsgTypeCmd, Msg: p.Msg}, pid)
+				peersMu.RUnlock()
+				return
+			}
+		}
+		peersMu.RUnlock()
+		c.logToUIf("not connected to a host")
+	}
+}
+
+// onHost returns an InboundHandler running action for the user who sent
+// the command, sending them back any error. Permissions were already
+// checked by handleInbound.
+func onHost(action func(c *Client, by, cmd string) error) InboundHandler {
+	return func(c *Client, p Packet, from peerID) {
+		peersMu.RLock()
+		peer, ok := c.peers[from]
+		if !ok || !c.host {
+			peersMu.RUnlock()
+			return
+		}
+		by := peer.name
+		peersMu.RUnlock()
+		if err := action(c, by, p.Msg); err != nil {
+			peersMu.RLock()
+			c.transmit(Packet{User: c.Name, Type: MsgTypeAdmin, Msg: err.Error()}, from)
+			peersMu.RUnlock()
+		}
+	}
+}
+
+// opUser makes a user an operator
+func opUser(c *Client, by, cmd string) error {
+	return c.setRole(by, commandArg(cmd), RoleOperator)
+}
+
+// deopUser makes an operator a regular member again
+func deopUser(c *Client, by, cmd string) error {
+	return c.setRole(by, commandArg(cmd), RoleMember)
+}
+
+// setRole changes the role of the user with the given name, telling
+// everyone about it along with the new member list
+func (c *Client) setRole(by, name string, role Role) error {
+	if name == "" {
+		return fmt.Errorf("a user name is needed")
+	}
+	peersMu.Lock()
+	var id string
+	var key []byte
+	for _, peer := range c.peers {
+		if peer.name == name {
+			id, key = peer.id, peer.key
+		}
+	}
+	if name == c.Name {
+		id, key = c.id, c.publicKey()
+	}
+	switch {
+	case id == "":
+		peersMu.Unlock()
+		return fmt.Errorf("not connected to \"%s\"", name)
+	case c.roleOf(id) == RoleOwner:
+		peersMu.Unlock()
+		return fmt.Errorf("\"%s\" owns the chat", name)
+	case c.roleOf(id) == role && role == RoleOperator:
+		peersMu.Unlock()
+		return fmt.Errorf("\"%s\" is already an operator", name)
+	case c.roleOf(id) == role:
+		peersMu.Unlock()
+		return fmt.Errorf("\"%s\" is not an operator", name)
+	case len(key) == 0:
+		peersMu.Unlock()
+		return fmt.Errorf("\"%s\" has no identity key to be told apart by; they may run an older lanchat version", name)
+	}
+	if role == RoleMember {
+		delete(c.roles, keyFingerprint(key))
+	} else {
+		if c.roles == nil {
+			c.roles = make(map[string]Role)
+		}
+		c.roles[keyFingerprint(key)] = role
+	}
+	msg := fmt.Sprintf("\"%s\" was made an operator by \"%s\"", name, by)
+	if role == RoleMember {
+		msg = fmt.Sprintf("\"%s\" is no longer an operator, as decided by \"%s\"", name, by)
+	}
+	c.sendMembers()
+	c.sendAll(Packet{User: c.Name, Type: MsgTypeAdmin, Msg: msg}, "")
+	peersMu.Unlock()
+	c.logToUI(msg)
+	return nil
+}
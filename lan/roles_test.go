@@ -0,0 +1,142 @@
+package lan
+
+import (
+	"testing"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestOp(t *testing.T) {
+	c := newTestClient(true, 3, &NullScanner{})
+	c.peers["0"].id = "id0"
+	c.peers["0"].key = []byte("key0")
+	c.peers["1"].id = "id1"
+	c.peers["1"].key = []byte("key1")
+	c.peers["2"].id = "id2"
+
+	handleOutbound(&c, ui.Packet{Msg: ":op peer_0"})
+	if r := c.roleOf("id0"); r != RoleOperator {
+		t.Errorf("expected peer_0 to be an operator, got %v", r)
+	}
+	pkts, err := readFromPeer(&c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 2 || pkts[0].Type != MsgTypeMembers || pkts[1].Type != MsgTypeAdmin {
+		t.Fatalf("expected member list and admin message, got %+v", pkts)
+	}
+	for _, m := range pkts[0].Peers {
+		if m.ID == "id0" && (m.Role != RoleOperator || m.Key != keyFingerprint([]byte("key0"))) {
+			t.Errorf("expected peer_0 to be listed as operator, got %+v", m)
+		}
+	}
+
+	handleOutbound(&c, ui.Packet{Msg: ":op peer_0"})
+	handleOutbound(&c, ui.Packet{Msg: ":op testClient"})
+	handleOutbound(&c, ui.Packet{Msg: ":deop peer_1"})
+	handleOutbound(&c, ui.Packet{Msg: ":deop peer_0"})
+	if r := c.roleOf("id0"); r != RoleMember {
+		t.Errorf("expected peer_0 to be a member again, got %v", r)
+	}
+	handleOutbound(&c, ui.Packet{Msg: ":op peer_2"})
+	// roles don't outlive the connection
+	handleOutbound(&c, ui.Packet{Msg: ":op peer_1"})
+	c.cleanPeer("1")
+	if r := c.roleOfKey([]byte("key1")); r != RoleMember {
+		t.Errorf("expected role of peer_1 to be dropped, got %v", r)
+	}
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ui.Packet{
+		{Type: ui.PacketTypeAdmin, Msg: "\"peer_0\" was made an operator by \"testClient\""},
+		{Type: ui.PacketTypeAdmin, Msg: "\"peer_0\" is already an operator"},
+		{Type: ui.PacketTypeAdmin, Msg: "\"testClient\" owns the chat"},
+		{Type: ui.PacketTypeAdmin, Msg: "\"peer_1\" is not an operator"},
+		{Type: ui.PacketTypeAdmin, Msg: "\"peer_0\" is no longer an operator, as decided by \"testClient\""},
+		{Type: ui.PacketTypeAdmin, Msg: "\"peer_2\" has no identity key to be told apart by; they may run an older lanchat version"},
+		{Type: ui.PacketTypeAdmin, Msg: "\"peer_1\" was made an operator by \"testClient\""},
+	}
+	if err = compareUIPackets(expected, uiPackets); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInboundCmdNeedsRole(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     Role
+		cmd      string
+		kicked   bool
+		response string // admin message sent back to peer_0
+	}{
+		{"member", RoleMember, ":kick peer_1", false, ":kick needs the operator role"},
+		{"operator", RoleOperator, ":kick peer_1", true, ""},
+		{"operator kicking the owner", RoleOperator, ":kick testClient", false, "\"testClient\" owns the chat"},
+		{"operator naming operators", RoleOperator, ":op peer_1", false, ":op needs the owner role"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(true, 2, &NullScanner{})
+			c.peers["0"].id = "id0"
+			c.peers["0"].key = []byte("key0")
+			c.peers["1"].id = "id1"
+			c.roles = map[string]Role{keyFingerprint([]byte("key0")): tt.role}
+
+			handleInbound(&c, Packet{User: "peer_0", Type: MsgTypeCmd, Msg: tt.cmd}, "0")
+			if _, ok := c.peers["1"]; ok == tt.kicked {
+				t.Errorf("expected peer_1 to be kicked: %v", tt.kicked)
+			}
+			pkts, err := readFromPeer(&c, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.response == "" {
+				if len(pkts) < 1 || pkts[0].Type != MsgTypeKick || pkts[0].Msg != "\"peer_1\" was kicked by \"peer_0\"" {
+					t.Errorf("expected kick to be announced, got %+v", pkts)
+				}
+				return
+			}
+			if len(pkts) != 1 || pkts[0].Type != MsgTypeAdmin || pkts[0].Msg != tt.response {
+				t.Errorf("expected response %q, got %+v", tt.response, pkts)
+			}
+		})
+	}
+}
+
+func TestOperatorAsksHost(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	var err error
+	if c.Identity, err = LoadIdentity(tempDir(t)); err != nil {
+		t.Fatal(err)
+	}
+	c.peers["0"].id = "hostID"
+	c.peers["0"].host = true
+	c.peers["1"].id = "id1"
+
+	// the host names this client an operator
+	handleInbound(&c, Packet{Type: MsgTypeMembers, Peers: []PeerInfo{
+		{ID: "hostID", Name: "peer_0", Role: RoleOwner},
+		{ID: "testClientID", Name: "testClient", Role: RoleOperator, Key: c.Identity.Fingerprint()},
+		{ID: "id1", Name: "peer_1"},
+	}}, "0")
+	if r := c.roleOf(c.id); r != RoleOperator {
+		t.Fatalf("expected to be an operator, got %v", r)
+	}
+	handleOutbound(&c, ui.Packet{Msg: ":mute peer_1"})
+
+	pkts, err := readFromPeer(&c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 1 || pkts[0].Type != MsgTypeCmd || pkts[0].Msg != ":mute peer_1" {
+		t.Errorf("expected command to be sent to the host, got %+v", pkts)
+	}
+	if pkts, _ = readFromPeer(&c, 1); len(pkts) != 0 {
+		t.Errorf("expected nothing sent to other peers, got %+v", pkts)
+	}
+	if c.muted["id1"] {
+		t.Error("expected peer_1 to be muted by the host only")
+	}
+}
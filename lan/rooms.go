@@ -0,0 +1,193 @@
+package lan
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+// DefaultRoom is the room every peer is in when starting
+const DefaultRoom = "general"
+
+// inRoom returns whether rooms contains room. Packets without a room predate
+// rooms and belong to all of them, while peers which haven't told which
+// rooms they are in only belong to the default one.
+func inRoom(rooms map[string]bool, room string) bool {
+	if room == "" {
+		return true
+	}
+	if rooms == nil {
+		return room == DefaultRoom
+	}
+	return rooms[room]
+}
+
+func roomSet(rooms []string) map[string]bool {
+	out := make(map[string]bool, len(rooms))
+	for _, r := range rooms {
+		out[r] = true
+	}
+	return out
+}
+
+func roomList(rooms map[string]bool) []string {
+	if rooms == nil {
+		return []string{DefaultRoom}
+	}
+	out := make([]string, 0, len(rooms))
+	for r := range rooms {
+		out = append(out, r)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// parseRoom returns the room given as single argument to a command, without
+// any leading '#'
+func parseRoom(msg string) (string, error) {
+	args := strings.Split(msg, " ")
+	if len(args) != 2 || strings.TrimLeft(args[1], "#") == "" {
+		return "", fmt.Errorf("%s needs a single, non-empty argument, received %v", args[0], args[1:])
+	}
+	return strings.TrimLeft(args[1], "#"), nil
+}
+
+func joinInHandler(c *Client, p Packet, from peerID) {
+	room, err := parseRoom(p.Msg)
+	if err != nil {
+		return
+	}
+	peersMu.Lock()
+	defer peersMu.Unlock()
+	if peer, ok := c.peers[from]; ok {
+		if peer.rooms == nil {
+			peer.rooms = roomSet(roomList(nil))
+		}
+		peer.rooms[room] = true
+		if inRoom(c.rooms, room) {
+			c.logToUIf("user \"%s\" joined #%s", peer.name, room)
+		}
+	}
+}
+
+func leaveInHandler(c *Client, p Packet, from peerID) {
+	room, err := parseRoom(p.Msg)
+	if err != nil {
+		return
+	}
+	peersMu.Lock()
+	defer peersMu.Unlock()
+	if peer, ok := c.peers[from]; ok {
+		if peer.rooms == nil {
+			peer.rooms = roomSet(roomList(nil))
+		}
+		delete(peer.rooms, room)
+		if inRoom(c.rooms, room) {
+			c.logToUIf("user \"%s\" left #%s", peer.name, room)
+		}
+	}
+}
+
+// joinOutHandler joins a room, if not in it yet, and makes it the one
+// messages are sent to
+func joinOutHandler(c *Client, p ui.Packet) {
+	room, err := parseRoom(p.Msg)
+	if err != nil {
+		c.logToUIf("%v\n", err)
+		return
+	}
+	peersMu.Lock()
+	if c.rooms == nil {
+		c.rooms = roomSet(roomList(nil))
+	}
+	joined := !c.rooms[room]
+	c.rooms[room] = true
+	c.room = room
+	peersMu.Unlock()
+	c.setActiveRoom(room)
+	if joined {
+		c.broadcast(Packet{User: c.Name, Msg: ":join " + room, Type: MsgTypeCmd}, "")
+		go c.replayLog(room)
+	}
+}
+
+func leaveOutHandler(c *Client, p ui.Packet) {
+	room, err := parseRoom(p.Msg)
+	if err != nil {
+		c.logToUIf("%v\n", err)
+		return
+	}
+	peersMu.Lock()
+	if !inRoom(c.rooms, room) {
+		peersMu.Unlock()
+		c.logToUIf("not in room #%s\n", room)
+		return
+	}
+	rooms := roomList(c.rooms)
+	if len(rooms) < 2 {
+		peersMu.Unlock()
+		c.logToUIf("can't leave #%s, as it is the only room you are in\n", room)
+		return
+	}
+	if c.rooms == nil {
+		c.rooms = roomSet(rooms)
+	}
+	delete(c.rooms, room)
+	active := c.activeRoom()
+	if active == room {
+		active = roomList(c.rooms)[0]
+		c.room = active
+	}
+	peersMu.Unlock()
+	c.broadcast(Packet{User: c.Name, Msg: ":leave " + room, Type: MsgTypeCmd}, "")
+	c.setActiveRoom(active)
+}
+
+// roomsOutHandler lists the rooms known to this client, with their members
+func roomsOutHandler(c *Client, p ui.Packet) {
+	peersMu.RLock()
+	members := make(map[string][]string)
+	for _, r := range roomList(c.rooms) {
+		members[r] = append(members[r], c.Name+" (you)")
+	}
+	for _, peer := range c.peers {
+		for _, r := range roomList(peer.rooms) {
+			members[r] = append(members[r], peer.name)
+		}
+	}
+	active := c.activeRoom()
+	peersMu.RUnlock()
+
+	rooms := make([]string, 0, len(members))
+	for r := range members {
+		rooms = append(rooms, r)
+	}
+	sort.Strings(rooms)
+	var b strings.Builder
+	b.WriteString("Rooms (* marks the active one):\n")
+	for _, r := range rooms {
+		marker := " "
+		if r == active {
+			marker = "*"
+		}
+		b.WriteString(fmt.Sprintf("%s #%-15s\t%s\n", marker, r, strings.Join(members[r], ", ")))
+	}
+	c.logToUI(b.String())
+}
+
+// activeRoom returns the room messages are sent to. Callers must hold
+// peersMu.
+func (c *Client) activeRoom() string {
+	if c.room == "" {
+		return DefaultRoom
+	}
+	return c.room
+}
+
+func (c *Client) setActiveRoom(room string) {
+	go func() {
+		c.ToUI <- ui.Packet{Type: ui.PacketTypeCmd, Msg: ":room " + room}
+	}()
+}
@@ -0,0 +1,90 @@
+package lan
+
+import (
+	"testing"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestRoomRouting(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	c.rooms = roomSet([]string{DefaultRoom, "backend"})
+	c.room = "backend"
+	c.peers["1"].rooms = roomSet([]string{"backend"})
+
+	handleOutbound(&c, ui.Packet{Msg: "deploying"})
+
+	pkts, err := readFromPeer(&c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 0 {
+		t.Errorf("expected peer outside of room to receive nothing, got %+v", pkts)
+	}
+	pkts, err = readFromPeer(&c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 1 || pkts[0].Room != "backend" || pkts[0].Msg != "deploying" {
+		t.Errorf("expected message to #backend, got %+v", pkts)
+	}
+}
+
+func TestRoomsInbound(t *testing.T) {
+	tests := []inboundTest{
+		{
+			"chat message to joined room",
+			"0",
+			Packet{User: "peer_0", Msg: "test", Room: DefaultRoom},
+			[]ui.Packet{{User: "peer_0", Msg: "test", Room: DefaultRoom}},
+			[][]Packet{{}, {}},
+		},
+		{
+			"chat message to other room",
+			"0",
+			Packet{User: "peer_0", Msg: "test", Room: "frontend"},
+			[]ui.Packet{},
+			[][]Packet{{}, {}},
+		},
+		{
+			"peer joins room",
+			"0",
+			Packet{User: "peer_0", Msg: ":join #general", Type: MsgTypeCmd},
+			[]ui.Packet{{Msg: "user \"peer_0\" joined #general", Type: ui.PacketTypeAdmin}},
+			[][]Packet{{}, {}},
+		},
+		{
+			"peer leaves room",
+			"0",
+			Packet{User: "peer_0", Msg: ":leave general", Type: MsgTypeCmd},
+			[]ui.Packet{{Msg: "user \"peer_0\" left #general", Type: ui.PacketTypeAdmin}},
+			[][]Packet{{}, {}},
+		},
+	}
+	runInboundTests(t, false, tests)
+}
+
+func TestLeaveOutHandler(t *testing.T) {
+	c := newTestClient(false, 1, &NullScanner{})
+	leaveOutHandler(&c, ui.Packet{Msg: ":leave general"})
+	if !inRoom(c.rooms, DefaultRoom) {
+		t.Errorf("expected to stay in the only room")
+	}
+
+	c.rooms = roomSet([]string{DefaultRoom, "backend"})
+	c.room = "backend"
+	leaveOutHandler(&c, ui.Packet{Msg: ":leave backend"})
+	if inRoom(c.rooms, "backend") {
+		t.Errorf("expected to leave #backend")
+	}
+	if c.activeRoom() != DefaultRoom {
+		t.Errorf("expected active room to be #%s, got #%s", DefaultRoom, c.activeRoom())
+	}
+	pkts, err := readFromPeer(&c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 1 || pkts[0].Msg != ":leave backend" {
+		t.Errorf("expected peer to be told about leaving, got %+v", pkts)
+	}
+}
@@ -3,8 +3,10 @@ package lan
 import (
 	"context"
 	"encoding/binary"
-	"fmt"
 	"net"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,11 +24,12 @@ func (s *NullScanner) FindHost(port int) (string, bool) {
 }
 
 type DefaultScanner struct {
-	Local bool
+	Local      bool
+	Interfaces InterfaceFilter
 }
 
 func (s *DefaultScanner) FindHost(port int) (string, bool) {
-	targets, err := findTargets()
+	targets, err := findTargets(s.Interfaces)
 	if err != nil {
 		logger.Errorf("FindHost: %v\n", err)
 		return "", false
@@ -36,56 +39,130 @@ func (s *DefaultScanner) FindHost(port int) (string, bool) {
 	return s.scanHost(hosts, port)
 }
 
+// InterfaceFilter selects the network interfaces whose networks are scanned.
+// Names may contain shell patterns, such as "wl*".
+type InterfaceFilter struct {
+	Include []string // if not empty, only these interfaces are scanned
+	Exclude []string
+}
+
+// name prefixes of interfaces created by containers, VMs and VPNs, which are
+// not scanned unless explicitly included
+var virtualPrefixes = []string{"docker", "br-", "veth", "virbr", "vboxnet", "vmnet", "lxcbr", "lxdbr", "cni", "flannel", "tun", "tap", "wg", "utun", "zt"}
+
+func (f InterfaceFilter) allows(ifc net.Interface) bool {
+	if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 {
+		return false
+	}
+	if matchAny(f.Exclude, ifc.Name) {
+		return false
+	}
+	if len(f.Include) > 0 {
+		return matchAny(f.Include, ifc.Name)
+	}
+	if ifc.Flags&net.FlagPointToPoint != 0 {
+		return false
+	}
+	for _, prefix := range virtualPrefixes {
+		if strings.HasPrefix(ifc.Name, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
 type targetRange struct {
 	selfIP string // IP from caller, to exclude from scan
 	netIP  string // IPNet network in CIDR notation
+	zone   string // interface name, for IPv6 link-local networks
 }
 
-// Returns list of target IP ranges to scan
-func findTargets() ([]targetRange, error) {
+// Returns list of target IP ranges to scan: the IPv4 networks and IPv6
+// link-local networks of all interfaces allowed by filter
+func findTargets(filter InterfaceFilter) ([]targetRange, error) {
 	out := make([]targetRange, 0, 4)
 	ifcs, err := net.Interfaces()
 	if err != nil {
 		return out, err
 	}
 	for _, ifc := range ifcs {
+		if !filter.allows(ifc) {
+			continue
+		}
 		addrs, err := ifc.Addrs()
 		if err != nil {
-			return out, err
-		}
-		for _, address := range addrs {
-			if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-				if ipnet.IP.To4() != nil {
-					t := targetRange{ipnet.IP.String(), ipnet.String()}
-					out = append(out, t)
-					return out, nil
-				}
-			}
+			logger.Debugf("findTargets: %s: %v\n", ifc.Name, err)
+			continue
 		}
+		out = append(out, interfaceTargets(ifc.Name, addrs)...)
 	}
 
 	return out, nil
 }
 
+func interfaceTargets(name string, addrs []net.Addr) []targetRange {
+	var out []targetRange
+	for _, address := range addrs {
+		ipnet, ok := address.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			out = append(out, targetRange{selfIP: ipnet.IP.String(), netIP: ipnet.String()})
+		} else if ipnet.IP.IsLinkLocalUnicast() {
+			out = append(out, targetRange{selfIP: ipnet.IP.String(), netIP: ipnet.String(), zone: name})
+		}
+	}
+	return out
+}
+
+// networks with more than 2^maxScanBits addresses are only swept around the
+// caller's IP
+const maxScanBits = 12
+
+// hostRange lists the IPv4 addresses of the target networks, except the
+// caller's. IPv6 networks are too large to be swept, and can only be found
+// via beacons.
 func hostRange(targets []targetRange) []string {
 	var hosts []string
+	skip := make(map[string]bool)
 	for _, t := range targets {
-		_, ipv4Net, err := net.ParseCIDR(t.netIP)
+		skip[t.selfIP] = true
+	}
+	for _, t := range targets {
+		selfIP, ipv4Net, err := net.ParseCIDR(t.netIP)
 		if err != nil {
 			logger.Errorf("hostRange: %v\n", err)
-			return []string{}
+			continue
+		}
+		if selfIP.To4() == nil {
+			continue
+		}
+		if ones, bits := ipv4Net.Mask.Size(); bits-ones > maxScanBits {
+			ipv4Net.Mask = net.CIDRMask(bits-maxScanBits, bits)
+			ipv4Net.IP = selfIP.Mask(ipv4Net.Mask)
 		}
 
 		mask := binary.BigEndian.Uint32(ipv4Net.Mask)
-		start := binary.BigEndian.Uint32(ipv4Net.IP)
+		start := binary.BigEndian.Uint32(ipv4Net.IP.To4())
 		finish := (start & mask) | (mask ^ 0xffffffff)
 
 		for i := start + 1; i <= finish-1; i++ {
 			ip := make(net.IP, 4)
 			binary.BigEndian.PutUint32(ip, i)
-			if ip.String() == t.selfIP {
+			if skip[ip.String()] {
 				continue
 			}
+			skip[ip.String()] = true
 			hosts = append(hosts, ip.String())
 		}
 
@@ -96,7 +173,7 @@ func hostRange(targets []targetRange) []string {
 
 func (s *DefaultScanner) scanHost(ips []string, chatPort int) (string, bool) {
 	if s.Local {
-		url := fmt.Sprintf("%s:%d", "127.0.0.1", chatPort)
+		url := net.JoinHostPort("127.0.0.1", strconv.Itoa(chatPort))
 		logger.Debugf("scanning %s\n", url)
 		conn, err := net.DialTimeout("tcp", url, 100*time.Millisecond)
 		if err == nil {
@@ -158,7 +235,7 @@ func popScan(ctx context.Context, chatPort int, in chan string, out chan string)
 				wg.Done()
 				return
 			}
-			url := fmt.Sprintf("%s:%d", host, chatPort)
+			url := net.JoinHostPort(host, strconv.Itoa(chatPort))
 			logger.Debugf("scanning %s", url)
 			conn, err := net.DialTimeout("tcp", url, timeout)
 			if err == nil {
@@ -0,0 +1,79 @@
+package lan
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestInterfaceFilter(t *testing.T) {
+	up := net.FlagUp | net.FlagBroadcast
+	tests := []struct {
+		name    string
+		filter  InterfaceFilter
+		ifc     net.Interface
+		allowed bool
+	}{
+		{"regular interface", InterfaceFilter{}, net.Interface{Name: "wlan0", Flags: up}, true},
+		{"interface down", InterfaceFilter{}, net.Interface{Name: "wlan0", Flags: net.FlagBroadcast}, false},
+		{"loopback", InterfaceFilter{}, net.Interface{Name: "lo", Flags: up | net.FlagLoopback}, false},
+		{"docker bridge", InterfaceFilter{}, net.Interface{Name: "docker0", Flags: up}, false},
+		{"point to point", InterfaceFilter{}, net.Interface{Name: "ppp0", Flags: net.FlagUp | net.FlagPointToPoint}, false},
+		{"excluded", InterfaceFilter{Exclude: []string{"eth*"}}, net.Interface{Name: "eth1", Flags: up}, false},
+		{"not included", InterfaceFilter{Include: []string{"eth0"}}, net.Interface{Name: "wlan0", Flags: up}, false},
+		{"included virtual interface", InterfaceFilter{Include: []string{"tun*"}}, net.Interface{Name: "tun0", Flags: net.FlagUp | net.FlagPointToPoint}, true},
+		{"included and excluded", InterfaceFilter{Include: []string{"eth*"}, Exclude: []string{"eth1"}}, net.Interface{Name: "eth1", Flags: up}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if allowed := tt.filter.allows(tt.ifc); allowed != tt.allowed {
+				t.Errorf("expected allowed=%v, got %v", tt.allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestInterfaceTargets(t *testing.T) {
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.IPv4(192, 168, 0, 5), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(64, 128)},
+	}
+	expected := []targetRange{
+		{selfIP: "192.168.0.5", netIP: "192.168.0.5/24"},
+		{selfIP: "fe80::1", netIP: "fe80::1/64", zone: "eth0"},
+	}
+	if got := interfaceTargets("eth0", addrs); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestHostRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []targetRange
+		count   int
+		first   string
+	}{
+		{"single network", []targetRange{{selfIP: "10.0.0.1", netIP: "10.0.0.1/29"}}, 5, "10.0.0.2"},
+		{
+			"same network on two interfaces",
+			[]targetRange{{selfIP: "10.0.0.1", netIP: "10.0.0.1/29"}, {selfIP: "10.0.0.2", netIP: "10.0.0.2/29"}},
+			4,
+			"10.0.0.3",
+		},
+		{"IPv6 network", []targetRange{{selfIP: "fe80::1", netIP: "fe80::1/64", zone: "eth0"}}, 0, ""},
+		{"large network", []targetRange{{selfIP: "10.1.200.1", netIP: "10.1.200.1/8"}}, 1<<maxScanBits - 3, "10.1.192.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts := hostRange(tt.targets)
+			if len(hosts) != tt.count {
+				t.Fatalf("expected %d hosts, got %d", tt.count, len(hosts))
+			}
+			if tt.count > 0 && hosts[0] != tt.first {
+				t.Errorf("expected first host to be %s, got %s", tt.first, hosts[0])
+			}
+		})
+	}
+}
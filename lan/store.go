@@ -0,0 +1,54 @@
+package lan
+
+import (
+	"time"
+
+	"github.com/MarcPer/lanchat/logger"
+	"github.com/MarcPer/lanchat/store"
+	"github.com/MarcPer/lanchat/ui"
+)
+
+// record saves a chat message to the on-disk log, if enabled
+func (c *Client) record(p Packet) {
+	if c.Store == nil {
+		return
+	}
+	room := p.Room
+	if room == "" {
+		room = DefaultRoom
+	}
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	m := store.Message{ID: p.ID, Time: t, Room: room, User: p.User, Msg: p.Msg}
+	if err := c.Store.Append(m); err != nil {
+		logger.Warnf("could not save message: %v\n", err)
+	}
+}
+
+// replayLog shows the messages saved for a room in previous sessions. They
+// are also kept in the history, to be replayed to other peers if this client
+// becomes the host.
+func (c *Client) replayLog(room string) {
+	if c.Store == nil {
+		return
+	}
+	msgs, err := c.Store.Load(room, c.LogReplay)
+	if err != nil {
+		logger.Warnf("could not load messages of #%s: %v\n", room, err)
+		return
+	}
+	// signatures aren't saved, so senders can't be verified anymore
+	sig := ui.SignatureValid
+	if c.Identity != nil {
+		sig = ui.SignatureUnverified
+	}
+	for _, m := range msgs {
+		if c.seen.check(m.ID) {
+			continue
+		}
+		c.history.add(Packet{User: m.User, Msg: m.Msg, ID: m.ID, Room: m.Room, Time: m.Time})
+		c.ToUI <- ui.Packet{User: m.User, Msg: m.Msg, Room: m.Room, Type: ui.PacketTypeHistory, Time: m.Time, Signature: sig}
+	}
+}
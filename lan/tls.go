@@ -0,0 +1,172 @@
+package lan
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MarcPer/lanchat/logger"
+)
+
+// NewTLSConfig returns the TLS configuration used to encrypt connections
+// between peers. The certificate is self-signed and generated on first use,
+// then stored in dir. Peers are not verified by TLS itself, but by comparing
+// their fingerprints with those seen before; see KnownPeers.
+func NewTLSConfig(dir string) (*tls.Config, error) {
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if os.IsNotExist(err) {
+		err = generateCertificate(certPath, keyPath)
+		if err == nil {
+			cert, err = tls.LoadX509KeyPair(certPath, keyPath)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// room key proofs are bound to the session with exported keying
+	// material, which is only safe to use from TLS 1.3 on
+	return &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+	}, nil
+}
+
+func generateCertificate(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "lanchat"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(20, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// peerFingerprint returns the SHA-256 hash of the certificate presented by
+// the peer on conn, or an empty string for unencrypted connections
+func peerFingerprint(conn net.Conn) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tc.ConnectionState()
+	if len(state.PeerCertificates) < 1 {
+		return ""
+	}
+	return certFingerprint(state.PeerCertificates[0].Raw)
+}
+
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// KnownPeers holds the fingerprints seen for each key, trusting the first
+// one seen (trust on first use). Certificates are pinned to the fingerprint
+// of the identity key of their peer, and identity keys to user names (see
+// Client.TrustedKeys). It is stored as a text file with one key and
+// fingerprint per line, separated by the last space on it, since user names
+// may contain spaces themselves.
+type KnownPeers struct {
+	path string
+	mu   sync.Mutex
+	pins map[string]string
+}
+
+func LoadKnownPeers(path string) (*KnownPeers, error) {
+	k := &KnownPeers{path: path, pins: make(map[string]string)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.LastIndex(line, " "); i > 0 && i < len(line)-1 {
+			k.pins[line[:i]] = line[i+1:]
+		}
+	}
+	return k, scanner.Err()
+}
+
+// Pin returns the fingerprint known for name. If there is none, fp is
+// stored and known is false.
+func (k *KnownPeers) Pin(name, fp string) (pinned string, known bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if pinned, ok := k.pins[name]; ok {
+		return pinned, true
+	}
+	k.pins[name] = fp
+	if err := k.save(); err != nil {
+		logger.Errorf("could not save known peers: %v\n", err)
+	}
+	return fp, false
+}
+
+// Lookup returns the fingerprint known for name, if any
+func (k *KnownPeers) Lookup(name string) (string, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	fp, ok := k.pins[name]
+	return fp, ok
+}
+
+// Set stores fp as the fingerprint of name, replacing the one known before
+func (k *KnownPeers) Set(name, fp string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pins[name] = fp
+	return k.save()
+}
+
+func (k *KnownPeers) save() error {
+	var b strings.Builder
+	for name, fp := range k.pins {
+		fmt.Fprintf(&b, "%s %s\n", name, fp)
+	}
+	return ioutil.WriteFile(k.path, []byte(b.String()), 0600)
+}
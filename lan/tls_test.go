@@ -0,0 +1,169 @@
+package lan
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "lanchat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := tempDir(t)
+	first, err := NewTLSConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewTLSConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp1 := certFingerprint(first.Certificates[0].Certificate[0])
+	fp2 := certFingerprint(second.Certificates[0].Certificate[0])
+	if fp1 != fp2 {
+		t.Errorf("expected certificate to be reused, got fingerprints %s and %s", fp1, fp2)
+	}
+}
+
+func TestKnownPeers(t *testing.T) {
+	path := filepath.Join(tempDir(t), "known_peers")
+	k, err := LoadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinned, known := k.Pin("jon", "aaaa"); known || pinned != "aaaa" {
+		t.Errorf("expected new fingerprint to be pinned, got pinned=%s, known=%v", pinned, known)
+	}
+	k.Pin("jon doe", "cccc")
+
+	k, err = LoadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinned, known := k.Pin("jon", "bbbb"); !known || pinned != "aaaa" {
+		t.Errorf("expected previous fingerprint, got pinned=%s, known=%v", pinned, known)
+	}
+	if pinned, known := k.Lookup("jon doe"); !known || pinned != "cccc" {
+		t.Errorf("expected fingerprint of name with a space, got pinned=%s, known=%v", pinned, known)
+	}
+}
+
+func TestEncryptedHandshake(t *testing.T) {
+	hostDir := tempDir(t)
+	guestDir := tempDir(t)
+	host := newTestClient(true, 0, &NullScanner{})
+	guest := newTestClient(false, 0, &NullScanner{})
+	guest.Name = "guest"
+	guest.id = "guestID"
+	var err error
+	if host.TLS, err = NewTLSConfig(hostDir); err != nil {
+		t.Fatal(err)
+	}
+	if guest.TLS, err = NewTLSConfig(guestDir); err != nil {
+		t.Fatal(err)
+	}
+	if host.Identity, err = LoadIdentity(hostDir); err != nil {
+		t.Fatal(err)
+	}
+	if guest.KnownPeers, err = LoadKnownPeers(filepath.Join(guestDir, "known_peers")); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", listen(t, &host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p, _, err := guest.handshake(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostFP := certFingerprint(host.TLS.Certificates[0].Certificate[0])
+	if p.fingerprint != hostFP {
+		t.Errorf("expected fingerprint %s, got %s", hostFP, p.fingerprint)
+	}
+	if pinned, ok := guest.KnownPeers.Lookup(host.Identity.Fingerprint()); !ok || pinned != hostFP {
+		t.Errorf("expected certificate to be pinned to the identity key of the host, got %q", pinned)
+	}
+
+	// someone else presents the same identity key
+	guest.KnownPeers.Set(host.Identity.Fingerprint(), "0123")
+	guest.id = "guest2ID"
+	second, err := net.Dial("tcp", listen(t, &host))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if _, _, err = guest.handshake(second); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected changed certificate to be refused, got %v", err)
+	}
+
+	uiPackets, err := readUI(&guest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uiPackets) != 2 || !strings.HasPrefix(uiPackets[1].Msg, "WARNING: fingerprint of \"testClient\" changed") {
+		t.Errorf("expected warning about changed fingerprint, got %+v", uiPackets)
+	}
+}
+
+func TestRelayedHandshake(t *testing.T) {
+	host := newTestClient(true, 0, &NullScanner{})
+	guest := newTestClient(false, 0, &NullScanner{})
+	guest.Name = "guest"
+	guest.id = "guestID"
+	host.RoomKey, guest.RoomKey = "secret", "secret"
+	var err error
+	if host.TLS, err = NewTLSConfig(tempDir(t)); err != nil {
+		t.Fatal(err)
+	}
+	if guest.TLS, err = NewTLSConfig(tempDir(t)); err != nil {
+		t.Fatal(err)
+	}
+	relay, err := NewTLSConfig(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listen(t, &host)
+
+	// someone in the middle decrypts everything, and passes it on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		in, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		out, err := net.Dial("tcp", addr)
+		if err != nil {
+			in.Close()
+			return
+		}
+		guestSide, hostSide := tls.Server(in, relay), tls.Client(out, relay)
+		go io.Copy(hostSide, guestSide)
+		io.Copy(guestSide, hostSide)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, err := guest.handshake(conn); err == nil || err.Error() != "peer does not know the room key" {
+		t.Errorf("expected relayed proof to be refused, got %v", err)
+	}
+}
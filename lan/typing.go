@@ -0,0 +1,32 @@
+package lan
+
+import "github.com/MarcPer/lanchat/ui"
+
+// typing tells the peers in the active room that the user is typing. The UI
+// asks for it every few seconds at most while the user types, and peers show
+// the indicator until these stop coming. Notices are ephemeral: they are
+// neither stamped nor relayed, and nothing is sent while offline, as it would
+// be stale by the time a host is found.
+func (c *Client) typing() {
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	if c.offline() || c.muted[c.id] {
+		return
+	}
+	c.sendAll(Packet{User: c.Name, Type: MsgTypeTyping, Room: c.activeRoom()}, "")
+}
+
+// typingInHandler shows that a peer is typing. Peers which aren't connected
+// to the sender yet miss the notice, which is fine for something this
+// short-lived.
+func typingInHandler(c *Client, p Packet, from peerID) {
+	if c.mutedSender(from) || c.ignoring(p) {
+		return
+	}
+	peersMu.RLock()
+	joined := inRoom(c.rooms, p.Room)
+	peersMu.RUnlock()
+	if joined {
+		c.ToUI <- ui.Packet{Type: ui.PacketTypeTyping, User: p.User, Room: p.Room}
+	}
+}
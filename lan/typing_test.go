@@ -0,0 +1,58 @@
+package lan
+
+import (
+	"testing"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestTyping(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	handleOutbound(&c, ui.Packet{Type: ui.PacketTypeTyping})
+	for i := 0; i < 2; i++ {
+		pkts, err := readFromPeer(&c, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pkts) != 1 || pkts[0].Type != MsgTypeTyping || pkts[0].User != "testClient" || pkts[0].Room != DefaultRoom || pkts[0].ID != "" {
+			t.Errorf("expected peer %d to be told the user is typing, got %+v", i, pkts)
+		}
+	}
+
+	c.muted = map[string]bool{c.id: true}
+	handleOutbound(&c, ui.Packet{Type: ui.PacketTypeTyping})
+	if pkts, _ := readFromPeer(&c, 0); len(pkts) != 0 {
+		t.Errorf("expected muted users not to send typing notices, got %+v", pkts)
+	}
+}
+
+func TestTypingInbound(t *testing.T) {
+	typing := Packet{User: "peer_0", Type: MsgTypeTyping, Room: DefaultRoom}
+	elsewhere := Packet{User: "peer_0", Type: MsgTypeTyping, Room: "backend"}
+
+	runInboundTests(t, true, []inboundTest{
+		{
+			"not relayed by the host",
+			"0",
+			typing,
+			[]ui.Packet{{User: "peer_0", Type: ui.PacketTypeTyping, Room: DefaultRoom}},
+			[][]Packet{{}, {}},
+		},
+		{
+			"in a room not joined",
+			"0",
+			elsewhere,
+			[]ui.Packet{},
+			[][]Packet{{}, {}},
+		},
+	})
+	runInboundTests(t, false, []inboundTest{
+		{
+			"received by a peer",
+			"0",
+			typing,
+			[]ui.Packet{{User: "peer_0", Type: ui.PacketTypeTyping, Room: DefaultRoom}},
+			[][]Packet{{}, {}},
+		},
+	})
+}
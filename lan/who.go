@@ -0,0 +1,186 @@
+package lan
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+// Version of lanchat, shown to peers in the roster. Release builds set it
+// with -ldflags "-X github.com/MarcPer/lanchat/lan.Version=..."
+var Version = "dev"
+
+// RosterEntry describes a member of the chat, as seen by the host
+type RosterEntry struct {
+	ID        string
+	Name      string
+	Addr      string
+	Connected time.Duration // how long the member has been connected to the host, or hosting
+	Presence  Presence
+	Client    string // lanchat version of the member; empty for peers predating it
+	Host      bool
+	Role      Role
+}
+
+// roster lists this client and every identified peer. Callers must hold
+// peersMu.
+func (c *Client) roster() []RosterEntry {
+	out := []RosterEntry{{
+		ID:        c.id,
+		Name:      c.Name,
+		Addr:      fmt.Sprintf(":%d", c.port),
+		Connected: time.Since(c.since).Round(time.Second),
+		Presence:  c.presence,
+		Client:    Version,
+		Host:      c.host,
+		Role:      c.roleOf(c.id),
+	}}
+	for _, p := range c.peers {
+		if p.id == "" {
+			continue
+		}
+		out = append(out, RosterEntry{
+			ID:        p.id,
+			Name:      p.name,
+			Addr:      p.addr,
+			Connected: time.Since(p.since).Round(time.Second),
+			Presence:  p.presence,
+			Client:    p.client,
+			Host:      p.host,
+			Role:      c.roleOf(p.id),
+		})
+	}
+	return out
+}
+
+// whoOutHandler shows everyone in the chat. Only the host is connected to
+// all of them for sure, so the roster is asked from it.
+func whoOutHandler(c *Client, p ui.Packet) {
+	peersMu.Lock()
+	if c.host {
+		roster := c.roster()
+		peersMu.Unlock()
+		c.showRoster(roster)
+		return
+	}
+	for pid, peer := range c.peers {
+		if peer.host {
+			c.askedWho = true
+			c.transmit(Packet{User: c.Name, Type: MsgTypeWho}, pid)
+			peersMu.Unlock()
+			return
+		}
+	}
+	roster := c.roster()
+	peersMu.Unlock()
+	c.logToUIf("not connected to a host; showing your own connections only")
+	c.showRoster(roster)
+}
+
+func whoInHandler(c *Client, p Packet, from peerID) {
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	if !c.host {
+		return
+	}
+	c.transmit(Packet{User: c.Name, Type: MsgTypeRoster, Roster: c.roster()}, from)
+}
+
+// rosterInHandler shows the roster sent by the host, in answer to :who. Any
+// other roster is ignored, so that peers can't pass off a fake one.
+func rosterInHandler(c *Client, p Packet, from peerID) {
+	peersMu.Lock()
+	peer, ok := c.peers[from]
+	if !ok || !peer.host || !c.askedWho {
+		peersMu.Unlock()
+		return
+	}
+	c.askedWho = false
+	peersMu.Unlock()
+	for i := range p.Roster {
+		p.Roster[i].Addr = resolveAddr(p.Roster[i].Addr, from)
+	}
+	c.showRoster(p.Roster)
+}
+
+// showRoster renders a roster as a table, listing the host first
+func (c *Client) showRoster(roster []RosterEntry) {
+	sort.SliceStable(roster, func(i, j int) bool {
+		if roster[i].Host != roster[j].Host {
+			return roster[i].Host
+		}
+		return roster[i].Name < roster[j].Name
+	})
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%d users\n", len(roster))
+	fmt.Fprint(w, "NAME\tADDRESS\tCONNECTED\tSTATUS\tVERSION")
+	for _, e := range roster {
+		name := e.Name
+		if e.ID == c.id {
+			name += " (you)"
+		}
+		if e.Host {
+			name += " (host)"
+		} else if e.Role == RoleOperator {
+			name += " (operator)"
+		}
+		client := e.Client
+		if client == "" {
+			client = "unknown"
+		}
+		fmt.Fprintf(w, "\n%s\t%s\t%v\t%s\t%s", name, e.Addr, e.Connected, e.Presence, client)
+	}
+	w.Flush()
+	c.logToUI(b.String())
+}
+
+// peersChanged tells updatePeerList to refresh the peer list shown by the
+// UI. It never blocks, so callers may hold peersMu.
+func (c *Client) peersChanged() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// updatePeerList sends the UI the current peer list whenever it changes.
+// Changes happening while the UI is busy are merged into a single update.
+func (c *Client) updatePeerList(ctx context.Context) {
+	for {
+		select {
+		case <-c.changed:
+		case <-ctx.Done():
+			return
+		}
+		peersMu.RLock()
+		members := c.uiMembers()
+		peersMu.RUnlock()
+		select {
+		case c.ToUI <- ui.Packet{Type: ui.PacketTypePeers, Members: members}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// uiMembers lists this client and every identified peer, as shown in the
+// side panel of the UI. Callers must hold peersMu.
+func (c *Client) uiMembers() []ui.Member {
+	roster := c.roster()
+	out := make([]ui.Member, 0, len(roster))
+	for _, e := range roster {
+		out = append(out, ui.Member{
+			Name:   e.Name,
+			Status: e.Presence.Status,
+			Host:   e.Host,
+			Self:   e.ID == c.id,
+		})
+	}
+	return out
+}
@@ -0,0 +1,155 @@
+package lan
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/MarcPer/lanchat/ui"
+)
+
+func TestWhoAsksHost(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	c.peers["1"].host = true
+	handleOutbound(&c, ui.Packet{Msg: ":who"})
+
+	pkts, err := readFromPeer(&c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 1 || pkts[0].Type != MsgTypeWho {
+		t.Errorf("expected roster to be asked from the host, got %+v", pkts)
+	}
+	if pkts, _ = readFromPeer(&c, 0); len(pkts) != 0 {
+		t.Errorf("expected nothing to be sent to other peers, got %+v", pkts)
+	}
+}
+
+func TestWhoInHandler(t *testing.T) {
+	c := newTestClient(true, 2, &NullScanner{})
+	c.port = 6776
+	c.peers["0"].id = "id0"
+	c.peers["0"].addr = "10.0.0.2:6776"
+	c.peers["0"].client = "1.2.0"
+	c.peers["0"].presence = Presence{Status: PresenceAway}
+	handleInbound(&c, Packet{User: "peer_1", Type: MsgTypeWho}, "1")
+
+	pkts, err := readFromPeer(&c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkts) != 1 || pkts[0].Type != MsgTypeRoster {
+		t.Fatalf("expected roster to be sent back, got %+v", pkts)
+	}
+	// peer_1 never identified, so it isn't listed
+	roster := pkts[0].Roster
+	if len(roster) != 2 {
+		t.Fatalf("expected 2 roster entries, got %+v", roster)
+	}
+	if e := roster[0]; e.Name != c.Name || !e.Host || e.Addr != ":6776" || e.Client != Version {
+		t.Errorf("expected host to list itself first, got %+v", e)
+	}
+	if e := roster[1]; e.Name != "peer_0" || e.Host || e.Addr != "10.0.0.2:6776" || e.Client != "1.2.0" || e.Presence.Status != PresenceAway {
+		t.Errorf("unexpected entry for peer_0: %+v", e)
+	}
+}
+
+func TestRosterInHandler(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	hostPid := peerID(net.JoinHostPort("10.0.0.2", "50000"))
+	c.peers[hostPid] = c.peers["0"]
+	c.peers[hostPid].host = true
+	delete(c.peers, "0")
+	roster := []RosterEntry{
+		{ID: "hostID", Name: "anna", Addr: ":6776", Presence: Presence{Status: PresenceOnline}, Client: "1.2.0", Host: true},
+		{ID: c.id, Name: c.Name, Addr: "10.0.0.3:6776", Presence: Presence{Status: PresenceBusy}},
+	}
+	fake := []RosterEntry{{ID: "id1", Name: "mallory", Host: true}}
+
+	// rosters are only shown when sent by the host, after asking for one
+	handleInbound(&c, Packet{User: "anna", Type: MsgTypeRoster, Roster: fake}, hostPid)
+	handleOutbound(&c, ui.Packet{Msg: ":who"})
+	handleInbound(&c, Packet{User: "peer_1", Type: MsgTypeRoster, Roster: fake}, "1")
+	handleInbound(&c, Packet{User: "anna", Type: MsgTypeRoster, Roster: roster}, hostPid)
+	handleInbound(&c, Packet{User: "anna", Type: MsgTypeRoster, Roster: fake}, hostPid)
+
+	uiPackets, err := readUI(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uiPackets) != 1 {
+		t.Fatalf("expected a single table, got %+v", uiPackets)
+	}
+	lines := strings.Split(uiPackets[0].Msg, "\n")
+	if lines[0] != "2 users" || !strings.HasPrefix(lines[1], "NAME") {
+		t.Errorf("expected a table with a header, got %q", uiPackets[0].Msg)
+	}
+	for _, want := range [][]string{
+		{"anna (host)", "10.0.0.2:6776", "online", "1.2.0"},
+		{"testClient (you)", "10.0.0.3:6776", "busy", "unknown"},
+	} {
+		found := false
+		for _, l := range lines {
+			if containsAll(l, want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected a row with %v, got %q", want, uiPackets[0].Msg)
+		}
+	}
+}
+
+func containsAll(s string, subs []string) bool {
+	for _, sub := range subs {
+		if !strings.Contains(s, sub) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPeerListUpdates(t *testing.T) {
+	c := newTestClient(false, 2, &NullScanner{})
+	c.presence = Presence{Status: PresenceOnline}
+	c.changed = make(chan struct{}, 1)
+	c.peers["0"].id = "id0"
+	c.peers["0"].host = true
+	c.peers["1"].id = "id1"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.updatePeerList(ctx)
+
+	// changes made while the UI is busy are sent in a single update
+	handleInbound(&c, Packet{User: "peer_1", Type: MsgTypePresence, Presence: &Presence{Status: PresenceAway}}, "1")
+	handleInbound(&c, Packet{User: "peer_1", Type: MsgTypeCmd, Msg: ":id bob"}, "1")
+
+	var members []ui.Member
+	waitFor(t, func() bool {
+		select {
+		case p := <-c.ToUI:
+			if p.Type == ui.PacketTypePeers {
+				members = p.Members
+			}
+		default:
+		}
+		for _, m := range members {
+			if m.Name == "bob" {
+				return true
+			}
+		}
+		return false
+	})
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	expected := []ui.Member{
+		{Name: "bob", Status: PresenceAway},
+		{Name: "peer_0", Host: true},
+		{Name: c.Name, Status: PresenceOnline, Self: true},
+	}
+	if !reflect.DeepEqual(members, expected) {
+		t.Errorf("expected members %+v, got %+v", expected, members)
+	}
+}
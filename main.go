@@ -5,33 +5,79 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/MarcPer/lanchat/lan"
 	"github.com/MarcPer/lanchat/logger"
+	"github.com/MarcPer/lanchat/store"
 	"github.com/MarcPer/lanchat/ui"
 )
 
 func main() {
 	cfg := newConfig()
 	ui.EnableNotification = cfg.notify
+	ui.AwayAfter = cfg.awayAfter
 	toUI := make(chan ui.Packet, 2)    // used by client to send info to UI
 	fromUI := make(chan ui.Packet, 10) // used by UI to send info to client
 
+	if err := os.MkdirAll(cfg.dir, 0700); err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig, err := lan.NewTLSConfig(cfg.dir)
+	if err != nil {
+		log.Fatalf("failed to load TLS certificate: %v", err)
+	}
+	knownPeers, err := lan.LoadKnownPeers(filepath.Join(cfg.dir, "known_peers"))
+	if err != nil {
+		log.Fatalf("failed to load known peers: %v", err)
+	}
+	identity, err := lan.LoadIdentity(cfg.dir)
+	if err != nil {
+		log.Fatalf("failed to load identity key: %v", err)
+	}
+	trustedKeys, err := lan.LoadKnownPeers(filepath.Join(cfg.dir, "trusted_keys"))
+	if err != nil {
+		log.Fatalf("failed to load trusted keys: %v", err)
+	}
+	bans, err := lan.LoadBanList(filepath.Join(cfg.dir, "bans"))
+	if err != nil {
+		log.Fatalf("failed to load ban list: %v", err)
+	}
+	ignored, err := lan.LoadIgnoreList(filepath.Join(cfg.dir, "ignored"))
+	if err != nil {
+		log.Fatalf("failed to load ignored users: %v", err)
+	}
+	var msgStore *store.Store
+	if cfg.log {
+		msgStore, err = store.Open(filepath.Join(cfg.dir, "logs"), cfg.retention)
+		if err != nil {
+			log.Fatalf("failed to open message log: %v", err)
+		}
+		defer msgStore.Close()
+	}
+
 	var scanner lan.NetScanner
+	var announcer lan.Announcer
+	interfaces := lan.InterfaceFilter{Include: cfg.include, Exclude: cfg.exclude}
+	sweep := &lan.DefaultScanner{Local: cfg.local, Interfaces: interfaces}
+	if cfg.discovery == "sweep" {
+		scanner = sweep
+	} else {
+		beacon := &lan.BeaconScanner{Local: cfg.local, Network: cfg.network, RoomKey: cfg.roomKey, Interfaces: interfaces, Fallback: sweep}
+		scanner = beacon
+		announcer = beacon
+	}
 	if cfg.forceHost {
 		scanner = &lan.NullScanner{}
-	} else {
-		scanner = &lan.DefaultScanner{Local: cfg.local}
-
 	}
 	logger.Infof("Starting UI\n")
 	renderer := ui.New(cfg.username, toUI, fromUI)
-	logger.Init(&renderer)
+	logger.Init(renderer)
 	f := debugFile()
 	defer f.Close()
 	logger.InitDebug(f)
 
-	client := &lan.Client{Name: cfg.username, HostPort: cfg.port, FromUI: fromUI, ToUI: toUI, Scanner: scanner}
+	client := &lan.Client{Name: cfg.username, HostPort: cfg.port, Network: cfg.network, RoomKey: cfg.roomKey, FromUI: fromUI, ToUI: toUI, Scanner: scanner, Announcer: announcer, TLS: tlsConfig, KnownPeers: knownPeers, Identity: identity, TrustedKeys: trustedKeys, Bans: bans, Ignored: ignored, HistorySize: cfg.history, Store: msgStore, LogReplay: cfg.logReplay, MaxMissedPings: cfg.maxMissed, DownloadDir: cfg.downloads}
 	ctx, cancel := context.WithCancel(context.Background())
 	client.Start(ctx)
 	renderer.Run()
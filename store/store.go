@@ -0,0 +1,173 @@
+// Package store keeps chat messages on disk, so that they can be looked up
+// after restarting. Messages are appended to one file per room, holding a
+// JSON object per line.
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ext = ".jsonl"
+
+type Message struct {
+	ID   string    `json:"id,omitempty"`
+	Time time.Time `json:"time"`
+	Room string    `json:"room"`
+	User string    `json:"user"`
+	Msg  string    `json:"msg"`
+}
+
+type Store struct {
+	dir       string
+	retention time.Duration
+	mu        sync.Mutex
+	files     map[string]*os.File
+}
+
+// Open returns a store keeping its files in dir. Messages older than
+// retention are dropped; if it is 0, they are kept forever.
+func Open(dir string, retention time.Duration) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir, retention: retention, files: make(map[string]*os.File)}
+	if err := s.prune(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) path(room string) string {
+	return filepath.Join(s.dir, url.PathEscape(room)+ext)
+}
+
+// Append adds a message to the file of its room
+func (s *Store) Append(m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[m.Room]
+	if !ok {
+		var err error
+		f, err = os.OpenFile(s.path(m.Room), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		s.files[m.Room] = f
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// Load returns up to limit of the most recent messages of a room, oldest
+// first
+func (s *Store) Load(room string, limit int) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs, err := s.read(room)
+	if err != nil {
+		return nil, err
+	}
+	if limit >= 0 && len(msgs) > limit {
+		msgs = msgs[len(msgs)-limit:]
+	}
+	return msgs, nil
+}
+
+// read returns all messages of a room within the retention period. Lines
+// which can't be parsed, e.g. if lanchat stopped while writing them, are
+// skipped.
+func (s *Store) read(room string) ([]Message, error) {
+	f, err := os.Open(s.path(room))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cutoff time.Time
+	if s.retention > 0 {
+		cutoff = time.Now().Add(-s.retention)
+	}
+	var msgs []Message
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var m Message
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			continue
+		}
+		if m.Time.Before(cutoff) {
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, scanner.Err()
+}
+
+// prune rewrites the room files without messages older than the retention
+// period, removing files left empty
+func (s *Store) prune() error {
+	if s.retention <= 0 {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ext) {
+			continue
+		}
+		room, err := url.PathUnescape(strings.TrimSuffix(e.Name(), ext))
+		if err != nil {
+			continue
+		}
+		msgs, err := s.read(room)
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			os.Remove(s.path(room))
+			continue
+		}
+		var b strings.Builder
+		for _, m := range msgs {
+			line, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			b.Write(line)
+			b.WriteByte('\n')
+		}
+		if err := ioutil.WriteFile(s.path(room), []byte(b.String()), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for room, f := range s.files {
+		if e := f.Close(); e != nil {
+			err = e
+		}
+		delete(s.files, room)
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "lanchat-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestAppendAndLoad(t *testing.T) {
+	s, err := Open(tempDir(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := time.Now()
+	for _, m := range []Message{
+		{ID: "1", Time: now, Room: "general", User: "jon", Msg: "first"},
+		{ID: "2", Time: now, Room: "../backend", User: "jon", Msg: "elsewhere"},
+		{ID: "3", Time: now, Room: "general", User: "ann", Msg: "second"},
+		{ID: "4", Time: now, Room: "general", User: "jon", Msg: "third"},
+	} {
+		if err := s.Append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs, err := s.Load("general", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Msg != "second" || msgs[1].Msg != "third" {
+		t.Errorf("expected the two most recent messages, got %+v", msgs)
+	}
+	msgs, err = s.Load("../backend", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Msg != "elsewhere" {
+		t.Errorf("expected message of room ../backend, got %+v", msgs)
+	}
+	msgs, err = s.Load("frontend", 10)
+	if err != nil || len(msgs) != 0 {
+		t.Errorf("expected no messages in unknown room, got %+v (err=%v)", msgs, err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dir := tempDir(t)
+	s, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	s.Append(Message{Time: old, Room: "general", Msg: "old"})
+	s.Append(Message{Time: time.Now(), Room: "general", Msg: "new"})
+	s.Append(Message{Time: old, Room: "stale", Msg: "old"})
+	s.Close()
+
+	s, err = Open(dir, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	msgs, err := s.Load("general", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Msg != "new" {
+		t.Errorf("expected only recent message, got %+v", msgs)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stale"+ext)); !os.IsNotExist(err) {
+		t.Errorf("expected file of room without recent messages to be removed, got %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package ui
 import (
 	"fmt"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -14,50 +15,179 @@ import (
 
 var EnableNotification bool
 
+// AwayAfter is the time without typing after which the client is told the
+// user is idle, to mark them as away. Zero disables it.
+var AwayAfter time.Duration
+
 type PacketType int
 
 const (
 	PacketTypeChat = iota
 	PacketTypeAdmin
 	PacketTypeCmd
+	PacketTypePrivate
+	PacketTypeHistory
+	PacketTypeSent   // chat message sent by this user, shown along with its Status
+	PacketTypeStatus // new Status of a message sent by this user
+	PacketTypeRead   // sent to the client once the user has seen a message
+	PacketTypeIdle   // sent to the client once the user stops typing for AwayAfter
+	PacketTypeActive // sent to the client once an idle user types again
+	PacketTypePeers  // current list of everyone in the chat, shown in the side panel
+	PacketTypeTyping // sent to the client while the user types a chat message, and by the client while a peer does
+)
+
+// Status tells how far a message sent by this user got
+type Status int
+
+const (
+	StatusQueued    Status = iota // waiting to reconnect before being sent
+	StatusPending                 // not acknowledged by every recipient yet
+	StatusDelivered               // received by every recipient
+	StatusRead                    // seen by every recipient
 )
 
+func (s Status) String() string {
+	switch s {
+	case StatusDelivered:
+		return "delivered"
+	case StatusRead:
+		return "read"
+	case StatusQueued:
+		return "queued"
+	default:
+		return "pending"
+	}
+}
+
+// Signature tells whether a message was signed by the user it claims to
+// come from
+type Signature int
+
+const (
+	SignatureValid      Signature = iota // signed with the key known for the sender, or not checked
+	SignatureMissing                     // not signed, e.g. by older lanchat versions
+	SignatureMismatch                    // signed with a key other than the one known for the sender, or altered
+	SignatureUnverified                  // no key is known for the sender, e.g. since they left
+)
+
+// warning shown next to the sender of messages not signed by them
+func (s Signature) warning() string {
+	switch s {
+	case SignatureMissing:
+		return " [red::b](unsigned)[-:-:-]"
+	case SignatureMismatch:
+		return " [red::b](SIGNATURE MISMATCH)[-:-:-]"
+	case SignatureUnverified:
+		return " [yellow::](unverified)[-:-:-]"
+	default:
+		return ""
+	}
+}
+
 const selfColor = "#00ff00"
 
 type Packet struct {
-	User string
-	Msg  string
-	Type PacketType
+	User      string
+	Msg       string
+	Type      PacketType
+	Room      string
+	Time      time.Time // when the message was sent; the time it is shown if zero
+	ID        string    // message ID, sent with PacketTypeSent, PacketTypeStatus and PacketTypeRead
+	Status    Status    // sent with PacketTypeSent and PacketTypeStatus
+	Members   []Member  // sent with PacketTypePeers
+	Signature Signature // sent with PacketTypeChat, PacketTypePrivate and PacketTypeHistory
 }
 
+// Member is someone in the chat, as listed in the side panel
+type Member struct {
+	Name   string
+	Status string // presence, e.g. "away"
+	Host   bool
+	Self   bool // whether this is the user of this UI
+	Typing bool // set by the UI while the member is typing
+}
+
+// room shown in the input label until the client tells otherwise
+const defaultRoom = "general"
+
 type UI struct {
 	FromClient chan Packet
 	ToClient   chan Packet
 	app        *tview.Application
+	grid       *tview.Grid
 	chat       *tview.TextView
+	peers      *tview.TextView // side panel listing everyone in the chat
+	showPeers  bool
+	typingLine *tview.TextView // status line under the chat, telling who is typing
 	input      *tview.InputField
 	lastNotify time.Time
+	lastInput  time.Time            // when the user last typed something
+	idle       bool                 // whether the user stopped typing for AwayAfter
+	lastTyping time.Time            // when the client was last told the user is typing
+	typing     map[string]time.Time // peers typing in the active room, with when they were last seen typing
+	members    []Member             // everyone in the chat, as listed in the side panel
+	presence   string               // shown next to the user name, unless online
+	user       string
+	room       string // active room, which typed messages are sent to
+	lines      []line
+	status     map[string]Status // status of messages sent by this user, by ID
+	unread     []Packet          // messages received while the user was away
+	redraw     bool              // whether the chat window is to be redrawn for status changes
 }
 
-func New(user string, fromClient chan Packet, toClient chan Packet) UI {
-	grid := tview.NewGrid().SetRows(0, 1)
+// line is a line of the chat window. Lines showing messages sent by this
+// user have their ID set, and are rendered again when their status changes.
+type line struct {
+	id    string
+	text  string
+	shown string // text as printed, followed by the status if the ID is set
+}
+
+// maximum number of lines kept in the chat window
+const maxLines = 1000
+
+// time without typing after which the user is considered away, and received
+// messages are no longer marked as read
+const readTimeout = 60 * time.Second
+
+func New(user string, fromClient chan Packet, toClient chan Packet) *UI {
+	grid := tview.NewGrid().SetRows(0, 1, 1)
 	chat := newTextView("").Clear()
+	peers := newTextView("")
+	peers.SetBorder(true).SetTitle(" Peers ")
 	app := tview.NewApplication()
 	input := newInputField(app, user)
-	grid.AddItem(chat, 0, 0, 1, 1, 0, 0, false)
-	grid.AddItem(input, 1, 0, 1, 1, 0, 0, true)
 	app.SetRoot(grid, true).SetFocus(input)
 
-	u := UI{
+	u := &UI{
 		FromClient: fromClient,
 		ToClient:   toClient,
 		app:        app,
+		grid:       grid,
 		chat:       chat,
+		peers:      peers,
+		showPeers:  true,
+		typingLine: newTextView(""),
 		input:      input,
 		lastNotify: time.Now().Add(notifyCooldown),
+		lastInput:  time.Now(),
+		user:       user,
+		room:       defaultRoom,
+		status:     make(map[string]Status),
+		typing:     make(map[string]time.Time),
 	}
+	u.setLabel()
+	u.layout()
+	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == togglePeersKey {
+			u.showPeers = !u.showPeers
+			u.layout()
+			return nil
+		}
+		return event
+	})
 	input.SetDoneFunc(func(key tcell.Key) {
-		u.lastNotify = time.Now().Add(notifyCooldown)
+		u.touch()
 		if key == tcell.KeyEnter {
 			msg := input.GetText()
 			if msg == "" {
@@ -66,18 +196,118 @@ func New(user string, fromClient chan Packet, toClient chan Packet) UI {
 			pkt := Packet{Msg: msg}
 			toClient <- pkt
 			input.SetText("")
-			fmt.Fprintf(chat, "[%s::b]%s> [-:-:-]%s[-:-:-]\n", selfColor, user, pkt.Msg)
+			// chat messages are echoed by the client, once it assigns them
+			// an ID to track their status
+			if strings.HasPrefix(msg, ":") {
+				u.write("", fmt.Sprintf("%s[%s::b]%s> [-:-:-]%s[-:-:-]\n", timestamp(time.Time{}), selfColor, u.user, pkt.Msg))
+			}
 		}
 
 	})
 	input.SetChangedFunc(func(text string) {
-		u.lastNotify = time.Now().Add(notifyCooldown)
+		u.touch()
+		u.typed(text)
 	})
 	return u
 }
 
+// key showing or hiding the side panel listing peers
+const togglePeersKey = tcell.KeyCtrlP
+
+// width of the side panel listing peers, including its border
+const peersWidth = 24
+
+// layout places the chat window, the typing status line and the input field
+// in the grid, along with the side panel listing peers if it is shown
+func (u *UI) layout() {
+	u.grid.Clear()
+	if u.showPeers {
+		u.grid.SetColumns(0, peersWidth)
+		u.grid.AddItem(u.peers, 0, 1, 3, 1, 0, 0, false)
+	} else {
+		u.grid.SetColumns(0)
+	}
+	u.grid.AddItem(u.chat, 0, 0, 1, 1, 0, 0, false)
+	u.grid.AddItem(u.typingLine, 1, 0, 1, 1, 0, 0, false)
+	u.grid.AddItem(u.input, 2, 0, 1, 1, 0, 0, true)
+}
+
+// touch records that the user is typing
+func (u *UI) touch() {
+	u.lastNotify = time.Now().Add(notifyCooldown)
+	u.lastInput = time.Now()
+	u.markRead()
+	if u.idle {
+		u.idle = false
+		go func() {
+			u.ToClient <- Packet{Type: PacketTypeActive}
+		}()
+	}
+}
+
+// watchIdle tells the client once the user stops typing for AwayAfter
+func (u *UI) watchIdle() {
+	if AwayAfter <= 0 {
+		return
+	}
+	ticker := time.NewTicker(AwayAfter / 10)
+	defer ticker.Stop()
+	for range ticker.C {
+		u.app.QueueUpdate(func() {
+			if u.idle || time.Since(u.lastInput) < AwayAfter {
+				return
+			}
+			u.idle = true
+			go func() {
+				u.ToClient <- Packet{Type: PacketTypeIdle}
+			}()
+		})
+	}
+}
+
+// time between notices sent to the client while the user types
+const typingInterval = 2 * time.Second
+
+// time after the last notice from a peer for which they are shown as typing
+const typingTimeout = 5 * time.Second
+
+// typed tells the client that the user is typing a chat message, at most
+// every typingInterval
+func (u *UI) typed(text string) {
+	if text == "" || strings.HasPrefix(text, ":") || time.Since(u.lastTyping) < typingInterval {
+		return
+	}
+	u.lastTyping = time.Now()
+	go func() {
+		u.ToClient <- Packet{Type: PacketTypeTyping}
+	}()
+}
+
+// watchTyping stops showing peers as typing once typingTimeout passes
+// without hearing from them
+func (u *UI) watchTyping() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		u.app.QueueUpdateDraw(func() {
+			expired := false
+			for name, t := range u.typing {
+				if time.Since(t) >= typingTimeout {
+					delete(u.typing, name)
+					expired = true
+				}
+			}
+			if expired {
+				u.drawTyping()
+			}
+		})
+	}
+}
+
 func (u *UI) Run() {
 	go u.processPackets()
+	go u.watchIdle()
+	go u.watchTyping()
 	err := u.app.Run()
 
 	if err != nil {
@@ -106,6 +336,18 @@ func (u *UI) processPackets() {
 			f = u.drawMsg(pkt)
 		} else if pkt.Type == PacketTypeAdmin {
 			f = u.drawAdmin(pkt)
+		} else if pkt.Type == PacketTypeHistory {
+			f = u.drawHistory(pkt)
+		} else if pkt.Type == PacketTypePrivate {
+			f = u.drawPrivate(pkt)
+		} else if pkt.Type == PacketTypeSent {
+			f = u.drawSent(pkt)
+		} else if pkt.Type == PacketTypeStatus {
+			f = u.setStatus(pkt)
+		} else if pkt.Type == PacketTypePeers {
+			f = u.drawPeers(pkt)
+		} else if pkt.Type == PacketTypeTyping {
+			f = u.setTyping(pkt)
 		} else if pkt.Type == PacketTypeCmd {
 			u.processCommand(pkt)
 			f = func() {}
@@ -119,14 +361,235 @@ func (u *UI) processPackets() {
 
 func (u *UI) drawMsg(pkt Packet) func() {
 	return func() {
-		fmt.Fprintf(u.chat, "[yellow::b]%s> [-:-:-]%s[-:-:-]\n", pkt.User, pkt.Msg)
+		// messages from rooms other than the active one are tagged with it
+		var room string
+		if pkt.Room != "" && pkt.Room != u.room {
+			room = fmt.Sprintf("[gray::]#%s [-:-:-]", pkt.Room)
+		}
+		u.write("", fmt.Sprintf("%s%s[yellow::b]%s%s[yellow::b]> [-:-:-]%s[-:-:-]\n", timestamp(pkt.Time), room, pkt.User, pkt.Signature.warning(), pkt.Msg))
+		u.received(pkt)
+		u.notify(pkt)
+		// the message being typed has arrived
+		if _, ok := u.typing[pkt.User]; ok {
+			delete(u.typing, pkt.User)
+			u.drawTyping()
+		}
+	}
+}
+
+// drawHistory shows messages sent before joining, dimmed and without
+// notifications
+func (u *UI) drawHistory(pkt Packet) func() {
+	return func() {
+		var room string
+		if pkt.Room != "" && pkt.Room != u.room {
+			room = "#" + pkt.Room + " "
+		}
+		u.write("", fmt.Sprintf("%s[gray::]%s%s%s[gray::]> %s (history)[-:-:-]\n", timestamp(pkt.Time), room, pkt.User, pkt.Signature.warning(), pkt.Msg))
+	}
+}
+
+func (u *UI) drawPrivate(pkt Packet) func() {
+	return func() {
+		u.write("", fmt.Sprintf("%s[fuchsia::b]%s (private)%s[fuchsia::b]> [-:-:-][fuchsia::]%s[-:-:-]\n", timestamp(pkt.Time), pkt.User, pkt.Signature.warning(), pkt.Msg))
+		u.received(pkt)
 		u.notify(pkt)
 	}
 }
 
+// drawSent shows a chat message sent by this user, followed by its status
+func (u *UI) drawSent(pkt Packet) func() {
+	return func() {
+		var room string
+		if pkt.Room != "" && pkt.Room != u.room {
+			room = fmt.Sprintf("[gray::]#%s [-:-:-]", pkt.Room)
+		}
+		u.status[pkt.ID] = pkt.Status
+		u.write(pkt.ID, fmt.Sprintf("%s%s[%s::b]%s> [-:-:-]%s[-:-:-]", timestamp(pkt.Time), room, selfColor, u.user, pkt.Msg))
+	}
+}
+
+// setStatus shows the new status of a message sent by this user. Only its
+// line is rendered again, but the chat window can't change a line in place,
+// so its text is replaced once the status changes already queued are done:
+// a burst of receipts redraws it once.
+func (u *UI) setStatus(pkt Packet) func() {
+	return func() {
+		if s, ok := u.status[pkt.ID]; !ok || s == pkt.Status {
+			return
+		}
+		u.status[pkt.ID] = pkt.Status
+		// recent messages are the likeliest to change
+		for i := len(u.lines) - 1; i >= 0; i-- {
+			if u.lines[i].id == pkt.ID {
+				u.lines[i].shown = u.render(u.lines[i])
+				break
+			}
+		}
+		if !u.redraw {
+			u.redraw = true
+			go u.app.QueueUpdateDraw(u.redrawChat)
+		}
+	}
+}
+
+// redrawChat replaces the text of the chat window with the lines as rendered
+func (u *UI) redrawChat() {
+	u.redraw = false
+	var b strings.Builder
+	for _, l := range u.lines {
+		b.WriteString(l.shown)
+	}
+	u.chat.SetText(b.String())
+}
+
+// drawPeers lists everyone in the chat in the side panel: the host first,
+// then everyone else by name. Users who are away or busy are dimmed.
+func (u *UI) drawPeers(pkt Packet) func() {
+	members := append([]Member(nil), pkt.Members...)
+	sort.SliceStable(members, func(i, j int) bool {
+		if members[i].Host != members[j].Host {
+			return members[i].Host
+		}
+		return members[i].Name < members[j].Name
+	})
+	return func() {
+		u.members = members
+		u.listPeers()
+	}
+}
+
+// listPeers redraws the side panel, marking the members who are typing
+func (u *UI) listPeers() {
+	u.peers.Clear()
+	u.peers.SetTitle(fmt.Sprintf(" Peers (%d) ", len(u.members)))
+	for _, m := range u.members {
+		_, m.Typing = u.typing[m.Name]
+		fmt.Fprintln(u.peers, memberLine(m))
+	}
+}
+
+// setTyping shows that a peer is typing, if it is in the active room
+func (u *UI) setTyping(pkt Packet) func() {
+	return func() {
+		if pkt.Room != "" && pkt.Room != u.room {
+			return
+		}
+		u.typing[pkt.User] = time.Now()
+		u.drawTyping()
+	}
+}
+
+// drawTyping tells who is typing in the status line, e.g. "alice and bob
+// are typing…", and marks them in the side panel
+func (u *UI) drawTyping() {
+	u.listPeers()
+	names := make([]string, 0, len(u.typing))
+	for name := range u.typing {
+		names = append(names, tview.Escape(name))
+	}
+	sort.Strings(names)
+	var text string
+	switch n := len(names); {
+	case n == 0:
+	case n == 1:
+		text = names[0] + " is typing…"
+	case n <= 3:
+		text = strings.Join(names[:n-1], ", ") + " and " + names[n-1] + " are typing…"
+	default:
+		text = "several people are typing…"
+	}
+	u.typingLine.SetText("[gray::]" + text + "[-:-:-]")
+}
+
+// memberLine formats a member of the side panel, e.g. "bob (away)"
+func memberLine(m Member) string {
+	color := "white"
+	if m.Self {
+		color = selfColor
+	}
+	var marks string
+	if m.Host {
+		marks += " [yellow::](host)[-:-:-]"
+	}
+	if m.Typing {
+		marks += " [green::](typing)[-:-:-]"
+	}
+	if m.Status != "" && m.Status != "online" {
+		color = "gray"
+		marks += fmt.Sprintf(" [gray::](%s)[-:-:-]", m.Status)
+	}
+	return fmt.Sprintf("[%s::b]%s[-:-:-]%s", color, tview.Escape(m.Name), marks)
+}
+
+// write adds a line to the chat window. An ID marks messages sent by this
+// user, which are shown with their status.
+func (u *UI) write(id, text string) {
+	l := line{id: id, text: text}
+	l.shown = u.render(l)
+	u.lines = append(u.lines, l)
+	if len(u.lines) > maxLines {
+		if old := u.lines[0]; old.id != "" {
+			delete(u.status, old.id)
+		}
+		u.lines = u.lines[1:]
+	}
+	fmt.Fprint(u.chat, l.shown)
+}
+
+// render returns the text printed for l
+func (u *UI) render(l line) string {
+	if l.id == "" {
+		return l.text
+	}
+	return fmt.Sprintf("%s [gray::](%s)[-:-:-]\n", l.text, u.status[l.id])
+}
+
+// received keeps track of messages shown to the user, to tell their senders
+// once they are read
+func (u *UI) received(pkt Packet) {
+	if pkt.ID == "" {
+		return
+	}
+	u.unread = append(u.unread, pkt)
+	if time.Since(u.lastInput) < readTimeout {
+		u.markRead()
+	}
+}
+
+// markRead tells the client that the user has seen the messages received
+// while they were away
+func (u *UI) markRead() {
+	if len(u.unread) == 0 {
+		return
+	}
+	unread := u.unread
+	u.unread = nil
+	go func() {
+		for _, pkt := range unread {
+			u.ToClient <- Packet{Type: PacketTypeRead, ID: pkt.ID, User: pkt.User}
+		}
+	}()
+}
+
+// timestamp formats the time a message was sent, in front of it. The date is
+// only included for messages from previous days.
+func timestamp(t time.Time) string {
+	now := time.Now()
+	if t.IsZero() {
+		t = now
+	}
+	t = t.Local()
+	layout := "15:04"
+	if y, m, d := t.Date(); y != now.Year() || m != now.Month() || d != now.Day() {
+		layout = "Jan 02 15:04"
+	}
+	return fmt.Sprintf("[gray::]%s [-:-:-]", t.Format(layout))
+}
+
 func (u *UI) drawAdmin(pkt Packet) func() {
 	return func() {
-		fmt.Fprintf(u.chat, "[blue::]-- %s[-:-:-]\n", pkt.Msg)
+		u.write("", fmt.Sprintf("[blue::]-- %s[-:-:-]\n", pkt.Msg))
 	}
 }
 
@@ -145,25 +608,42 @@ func (u *UI) processCommand(pkt Packet) {
 		}
 
 		u.app.QueueUpdate(func() {
-			u.input.SetLabel(fmt.Sprintf("[%s::b]%s> [-:-:-]", selfColor, args[1]))
-			u.input.SetDoneFunc(func(key tcell.Key) {
-				u.lastNotify = time.Now().Add(notifyCooldown)
-				if key == tcell.KeyEnter {
-					msg := u.input.GetText()
-					if msg == "" {
-						return
-					}
-					pkt := Packet{Msg: msg}
-					u.ToClient <- pkt
-					u.input.SetText("")
-					fmt.Fprintf(u.chat, "[%s::b]%s> [-:-:-]%s[-:-:-]\n", selfColor, args[1], pkt.Msg)
-				}
+			u.user = args[1]
+			u.setLabel()
+		})
+	case ":room":
+		if len(args) != 2 || args[1] == "" {
+			logger.Warnf(":room needs a single, non-empty argument, received %v\n", args[1:])
+			return
+		}
+
+		u.app.QueueUpdate(func() {
+			u.room = args[1]
+			u.setLabel()
+		})
+	case ":presence":
+		if len(args) != 2 || args[1] == "" {
+			logger.Warnf(":presence needs a single, non-empty argument, received %v\n", args[1:])
+			return
+		}
 
-			})
+		u.app.QueueUpdate(func() {
+			u.presence = args[1]
+			u.setLabel()
 		})
 	}
 }
 
+// setLabel shows the user name, their presence and the active room in front
+// of the input field
+func (u *UI) setLabel() {
+	var presence string
+	if u.presence != "" && u.presence != "online" {
+		presence = fmt.Sprintf(" [gray::](%s)", u.presence)
+	}
+	u.input.SetLabel(fmt.Sprintf("[gray::]#%s [%s::b]%s%s[%s::b]> [-:-:-]", u.room, selfColor, u.user, presence, selfColor))
+}
+
 var notifyLock sync.Mutex
 
 const notifyCooldown = 60 * time.Second